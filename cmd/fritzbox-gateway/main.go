@@ -0,0 +1,58 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Command fritzbox-gateway serves a FRITZ!Box over HTTP as a small JSON
+// REST API plus an SSE event stream, so tools that can't embed Go (Home
+// Assistant, a Prometheus scraper, a shell script) can drive it.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/philippfranke/go-fritzbox/fritzbox"
+	"github.com/philippfranke/go-fritzbox/gateway"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	baseURL := flag.String("base-url", "http://fritz.box/", "FRITZ!Box base URL")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification of base-url")
+	flag.Parse()
+
+	u, err := url.Parse(*baseURL)
+	if err != nil {
+		log.Fatalf("base-url: %v", err)
+	}
+
+	httpClient := http.DefaultClient
+	if *insecure {
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	c := fritzbox.NewClient(httpClient)
+	c.BaseURL = u
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := c.EventService.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("fritzbox-gateway: event service stopped: %v", err)
+		}
+	}()
+
+	h := gateway.NewHandler(c)
+	log.Printf("fritzbox-gateway: listening on %s, proxying %s", *addr, u)
+	log.Fatal(http.ListenAndServe(*addr, h))
+}
@@ -2,11 +2,13 @@ package fritzbox
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -16,28 +18,57 @@ const (
 // DeviceService handles fritz!Box devices.
 type DeviceService struct {
 	c *Client
+
+	observersMu sync.Mutex
+	observers   []func(old, new DeviceState, d *Device)
 }
 
-// List returns a list of all devices
+// List returns a list of all devices. It is equivalent to ListContext
+// with context.Background().
 func (s *DeviceService) List() ([]*Device, error) {
+	return s.ListContext(context.Background())
+}
+
+// ListContext returns a list of all devices, bound to ctx.
+func (s *DeviceService) ListContext(ctx context.Context) ([]*Device, error) {
+	list, err := s.fetchDeviceList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return list.Devices, nil
+}
+
+// fetchDeviceList calls getdevicelistinfos and returns the decoded
+// response, which also backs GroupService.ListContext since groups are
+// returned alongside devices by the same call.
+func (s *DeviceService) fetchDeviceList(ctx context.Context) (*deviceList, error) {
 	u, err := commandURL("getdevicelistinfos", nil)
 	if err != nil {
 		return nil, err
 	}
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	var deviceList deviceList
-	if _, err := s.c.Do(req, &deviceList); err != nil {
+	var list deviceList
+	if _, err := s.c.DoWithContext(ctx, req, &list); err != nil {
 		return nil, err
 	}
-	return deviceList.Devices, nil
+	for _, d := range list.Devices {
+		d.svc = s
+	}
+	return &list, nil
 }
 
-// Get returns a single device.
+// Get returns a single device. It is equivalent to GetContext with
+// context.Background().
 func (s *DeviceService) Get(ain string) (*Device, error) {
-	list, err := s.List()
+	return s.GetContext(context.Background(), ain)
+}
+
+// GetContext returns a single device, bound to ctx.
+func (s *DeviceService) GetContext(ctx context.Context, ain string) (*Device, error) {
+	list, err := s.ListContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -64,12 +95,19 @@ func precheck(d *Device, lock bool) error {
 	return nil
 }
 
-// TurnOn turns a socket/thermostat on. grrr..
+// TurnOn turns a socket/thermostat on. grrr.. It is equivalent to
+// TurnOnContext with context.Background().
 func (s *DeviceService) TurnOn(d *Device) (bool, error) {
+	return s.TurnOnContext(context.Background(), d)
+}
+
+// TurnOnContext turns a socket/thermostat on, bound to ctx.
+func (s *DeviceService) TurnOnContext(ctx context.Context, d *Device) (bool, error) {
 	var u *url.URL
 	var err error
 
-	if err := precheck(d, true); err != nil {
+	from, to, err := d.planTransition(EventTurnOn)
+	if err != nil {
 		return false, err
 	}
 
@@ -89,22 +127,30 @@ func (s *DeviceService) TurnOn(d *Device) (bool, error) {
 		return false, err
 	}
 
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return false, err
 	}
-	if _, err = s.c.Do(req, nil); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, nil); err != nil {
 		return false, err
 	}
+	d.commitTransition(from, to)
 	return true, nil
 }
 
-// TurnOff turns a socket/thermostat off.
+// TurnOff turns a socket/thermostat off. It is equivalent to
+// TurnOffContext with context.Background().
 func (s *DeviceService) TurnOff(d *Device) (bool, error) {
+	return s.TurnOffContext(context.Background(), d)
+}
+
+// TurnOffContext turns a socket/thermostat off, bound to ctx.
+func (s *DeviceService) TurnOffContext(ctx context.Context, d *Device) (bool, error) {
 	var u *url.URL
 	var err error
 
-	if err := precheck(d, true); err != nil {
+	from, to, err := d.planTransition(EventTurnOff)
+	if err != nil {
 		return false, err
 	}
 
@@ -123,30 +169,34 @@ func (s *DeviceService) TurnOff(d *Device) (bool, error) {
 		return false, err
 	}
 
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return false, err
 	}
 	var buf bytes.Buffer
-	if _, err = s.c.Do(req, &buf); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, &buf); err != nil {
 		return false, err
 	}
 	str := strings.TrimSpace(buf.String())
+	d.commitTransition(from, to)
 	if d.IsThermostat() {
 		return str == "253", nil
 	}
-	return strconv.ParseBool(strings.TrimSpace(buf.String()))
+	return strconv.ParseBool(str)
 }
 
 // Toggle will turn a socket on, if it is off. Or it will turn a socket off,
-// if it is on.
+// if it is on. It is equivalent to ToggleContext with context.Background().
 func (s *DeviceService) Toggle(d *Device) (bool, error) {
-	if err := precheck(d, true); err != nil {
+	return s.ToggleContext(context.Background(), d)
+}
+
+// ToggleContext toggles a socket, bound to ctx.
+func (s *DeviceService) ToggleContext(ctx context.Context, d *Device) (bool, error) {
+	from, to, err := d.planTransition(EventToggle)
+	if err != nil {
 		return false, err
 	}
-	if !d.IsSocket() {
-		return false, fmt.Errorf("device %q does not support toggling", d.Identifier)
-	}
 	params := map[string]string{
 		"ain": cleanAin(d.Identifier),
 	}
@@ -154,18 +204,25 @@ func (s *DeviceService) Toggle(d *Device) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return false, err
 	}
-	if _, err = s.c.Do(req, nil); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, nil); err != nil {
 		return false, err
 	}
+	d.commitTransition(from, to)
 	return true, nil
 }
 
-// GetPower returns the power currently consumed.
+// GetPower returns the power currently consumed. It is equivalent to
+// GetPowerContext with context.Background().
 func (s *DeviceService) GetPower(d *Device) (int64, error) {
+	return s.GetPowerContext(context.Background(), d)
+}
+
+// GetPowerContext returns the power currently consumed, bound to ctx.
+func (s *DeviceService) GetPowerContext(ctx context.Context, d *Device) (int64, error) {
 	if err := precheck(d, false); err != nil {
 		return 0, err
 	}
@@ -179,12 +236,12 @@ func (s *DeviceService) GetPower(d *Device) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return 0, err
 	}
 	var buf bytes.Buffer
-	if _, err = s.c.Do(req, &buf); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, &buf); err != nil {
 		return 0, err
 	}
 	str := strings.TrimSpace(buf.String())
@@ -195,8 +252,14 @@ func (s *DeviceService) GetPower(d *Device) (int64, error) {
 	return power, nil
 }
 
-// GetEnergy returns the energy since last reset :D.
+// GetEnergy returns the energy since last reset :D. It is equivalent to
+// GetEnergyContext with context.Background().
 func (s *DeviceService) GetEnergy(d *Device) (int64, error) {
+	return s.GetEnergyContext(context.Background(), d)
+}
+
+// GetEnergyContext returns the energy since last reset, bound to ctx.
+func (s *DeviceService) GetEnergyContext(ctx context.Context, d *Device) (int64, error) {
 	if err := precheck(d, false); err != nil {
 		return 0, err
 	}
@@ -210,12 +273,12 @@ func (s *DeviceService) GetEnergy(d *Device) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return 0, err
 	}
 	var buf bytes.Buffer
-	if _, err = s.c.Do(req, &buf); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, &buf); err != nil {
 		return 0, err
 	}
 	str := strings.TrimSpace(buf.String())
@@ -226,8 +289,15 @@ func (s *DeviceService) GetEnergy(d *Device) (int64, error) {
 	return power, nil
 }
 
-// GetTemperature returns the device's current temperature.
+// GetTemperature returns the device's current temperature. It is
+// equivalent to GetTemperatureContext with context.Background().
 func (s *DeviceService) GetTemperature(d *Device) (float64, error) {
+	return s.GetTemperatureContext(context.Background(), d)
+}
+
+// GetTemperatureContext returns the device's current temperature, bound
+// to ctx.
+func (s *DeviceService) GetTemperatureContext(ctx context.Context, d *Device) (float64, error) {
 	if err := precheck(d, false); err != nil {
 		return 0, err
 	}
@@ -240,12 +310,15 @@ func (s *DeviceService) GetTemperature(d *Device) (float64, error) {
 	}
 
 	u, err := commandURL("gettemperature", params)
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return 0, err
 	}
 	var buf bytes.Buffer
-	if _, err = s.c.Do(req, &buf); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, &buf); err != nil {
 		return 0, err
 	}
 	str := strings.TrimSpace(buf.String())
@@ -257,14 +330,21 @@ func (s *DeviceService) GetTemperature(d *Device) (float64, error) {
 	return float64(temp) / 10.0, nil
 }
 
-// GetSollTemperature returns the thermostat's desired temperature.
+// GetSollTemperature returns the thermostat's desired temperature. It is
+// equivalent to GetSollTemperatureContext with context.Background().
 func (s *DeviceService) GetSollTemperature(d *Device) (float64, error) {
-	if !d.IsThermostat() {
-		return 0, fmt.Errorf("device %q does not support getting soll temperature", d.Identifier)
-	}
+	return s.GetSollTemperatureContext(context.Background(), d)
+}
+
+// GetSollTemperatureContext returns the thermostat's desired temperature,
+// bound to ctx.
+func (s *DeviceService) GetSollTemperatureContext(ctx context.Context, d *Device) (float64, error) {
 	if err := precheck(d, false); err != nil {
 		return 0, err
 	}
+	if !d.IsThermostat() {
+		return 0, fmt.Errorf("device %q does not support getting soll temperature", d.Identifier)
+	}
 	params := map[string]string{
 		"ain": cleanAin(d.Identifier),
 	}
@@ -272,19 +352,18 @@ func (s *DeviceService) GetSollTemperature(d *Device) (float64, error) {
 	if err != nil {
 		return 0, err
 	}
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return 0, err
 	}
 	var buf bytes.Buffer
-	if _, err = s.c.Do(req, &buf); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, &buf); err != nil {
 		return 0, err
 	}
 	temp, err := strconv.ParseInt(strings.TrimSpace(buf.String()), 10, 64)
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println(temp)
 	if temp == 253 || temp == 254 {
 		return 0, fmt.Errorf("device %q is off", d.Identifier)
 	}
@@ -292,17 +371,22 @@ func (s *DeviceService) GetSollTemperature(d *Device) (float64, error) {
 	return float64(temp) / 2, nil
 }
 
-// SetSollTemperature sets the thermostat's  desired temperature.
+// SetSollTemperature sets the thermostat's  desired temperature. It is
+// equivalent to SetSollTemperatureContext with context.Background().
 func (s *DeviceService) SetSollTemperature(d *Device, temp float64) error {
-	if err := precheck(d, true); err != nil {
-		return err
-	}
-	if !d.IsThermostat() {
-		return fmt.Errorf("Device %q does not support setting soll temperature", d.Identifier)
-	}
+	return s.SetSollTemperatureContext(context.Background(), d, temp)
+}
+
+// SetSollTemperatureContext sets the thermostat's desired temperature,
+// bound to ctx.
+func (s *DeviceService) SetSollTemperatureContext(ctx context.Context, d *Device, temp float64) error {
 	if temp < 8 || temp > 28 {
 		return fmt.Errorf("temperature needs to be between 8 and 28")
 	}
+	from, to, err := d.planTransition(EventSetSollTemperature)
+	if err != nil {
+		return err
+	}
 	params := map[string]string{
 		"ain": cleanAin(d.Identifier),
 	}
@@ -312,17 +396,18 @@ func (s *DeviceService) SetSollTemperature(d *Device, temp float64) error {
 	if err != nil {
 		return err
 	}
-	req, err := s.c.NewRequest("GET", u.String(), nil)
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return err
 	}
 	var buf bytes.Buffer
-	if _, err = s.c.Do(req, &buf); err != nil {
+	if _, err = s.c.DoWithContext(ctx, req, &buf); err != nil {
 		return err
 	}
 	if strings.TrimSpace(buf.String()) != params["param"] {
 		return fmt.Errorf("new temperature does not match desired temperature: %s", buf.String())
 	}
+	d.commitTransition(from, to)
 	return nil
 }
 
@@ -345,6 +430,9 @@ type deviceList struct {
 	XMLName xml.Name  `xml:"devicelist"`
 	Version string    `xml:"version,attr"`
 	Devices []*Device `xml:"device"`
+	// Groups are returned as siblings of Devices by the same
+	// getdevicelistinfos call; see GroupService.
+	Groups []*Group `xml:"group"`
 }
 
 // Device represents a device returned by the fritz!Box.
@@ -357,6 +445,56 @@ type Device struct {
 	Manufacturer    string   `xml:"manufacturer,attr"`
 	Name            string   `xml:"productname,attr"`
 	Lock            bool     `xml:"switch>lock"`
+
+	// SwitchState reports whether a socket is currently switched on, as
+	// returned in the device list (rather than via GetPower/GetEnergy).
+	SwitchState bool `xml:"switch>state"`
+
+	// PowerMW is the power currently drawn, in milliwatts, as returned
+	// in the device list.
+	PowerMW int64 `xml:"powermeter>power"`
+
+	// EnergyWh is the energy consumed since last reset, in Wh, as
+	// returned in the device list.
+	EnergyWh int64 `xml:"powermeter>energy"`
+
+	// TemperatureCelsius is the device's current temperature in tenths
+	// of a degree Celsius (200 means 20°), as returned in the device
+	// list.
+	TemperatureCelsius int64 `xml:"temperature>celsius"`
+
+	// SollTemperatureRaw is a thermostat's target temperature, in the
+	// same raw HKR units as GetSollTemperature/SetSollTemperature (e.g.
+	// 32 represents 16°), as returned in the device list.
+	SollTemperatureRaw int64 `xml:"hkr>tsoll"`
+
+	// ETSIUnitInfo describes the HAN-FUN unit underlying this device,
+	// if any (see IsHANFUNUnit).
+	ETSIUnitInfo *ETSIUnitInfo `xml:"etsiunitinfo"`
+
+	// Battery is a battery-powered device's remaining charge, as a
+	// percentage.
+	Battery int `xml:"battery"`
+
+	// BatteryLow reports whether a battery-powered device's battery
+	// needs replacing.
+	BatteryLow bool `xml:"batterylow"`
+
+	// TxBusy reports whether the device's radio is currently busy
+	// transmitting, e.g. applying a firmware update.
+	TxBusy bool `xml:"txbusy"`
+
+	// svc is the DeviceService the device was fetched through. It is
+	// set by List/Get so Transition can notify svc's observers.
+	svc *DeviceService
+}
+
+// ETSIUnitInfo describes the HAN-FUN unit backing a Device, as returned
+// in the device list's etsiunitinfo element.
+type ETSIUnitInfo struct {
+	ETSIDeviceID int    `xml:"etsideviceid"`
+	UnitType     int    `xml:"unittype"`
+	Interfaces   string `xml:"interfaces"`
 }
 
 // IsConnected reports whether a device is connected.
@@ -399,3 +537,102 @@ func (d *Device) HasEnergy() bool {
 func (d *Device) IsDECTRepeater() bool {
 	return d.FunctionBitMask&(1<<10) != 0
 }
+
+// IsHANFUNUnit reports whether a device is backed by a HAN-FUN unit,
+// e.g. a third-party smart home device paired via a HAN-FUN capable
+// FRITZ!Box. See Device.ETSIUnitInfo for details on the unit.
+func (d *Device) IsHANFUNUnit() bool {
+	return d.FunctionBitMask&(1<<13) != 0
+}
+
+// IsColorBulb reports whether a device is a bulb with settable color,
+// such as a DECT 500, supporting SetColor/SetColorTemperature/SetLevel.
+func (d *Device) IsColorBulb() bool {
+	return d.FunctionBitMask&(1<<17) != 0
+}
+
+// IsBlind reports whether a device is a blind/shutter, supporting
+// SetBlind.
+func (d *Device) IsBlind() bool {
+	return d.FunctionBitMask&(1<<23) != 0
+}
+
+// GetBasicDeviceStats returns d's historical temperature, voltage,
+// power, and energy readings. It is equivalent to
+// GetBasicDeviceStatsContext with context.Background().
+func (s *DeviceService) GetBasicDeviceStats(d *Device) (*DeviceStats, error) {
+	return s.GetBasicDeviceStatsContext(context.Background(), d)
+}
+
+// GetBasicDeviceStatsContext returns d's historical temperature,
+// voltage, power, and energy readings, bound to ctx.
+func (s *DeviceService) GetBasicDeviceStatsContext(ctx context.Context, d *Device) (*DeviceStats, error) {
+	if err := precheck(d, false); err != nil {
+		return nil, err
+	}
+	params := map[string]string{
+		"ain": cleanAin(d.Identifier),
+	}
+	u, err := commandURL("getbasicdevicestats", params)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var stats DeviceStats
+	if _, err := s.c.DoWithContext(ctx, req, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// DeviceStats holds the timeseries returned by GetBasicDeviceStats. Any
+// series the device does not support is left nil.
+type DeviceStats struct {
+	// TemperatureCelsiusTenths parallels Device.TemperatureCelsius.
+	TemperatureCelsiusTenths *StatsSeries `xml:"temperature>stats"`
+	// VoltageMV is in millivolts.
+	VoltageMV *StatsSeries `xml:"voltage>stats"`
+	// PowerMW parallels Device.PowerMW.
+	PowerMW *StatsSeries `xml:"power>stats"`
+	// EnergyWh parallels Device.EnergyWh.
+	EnergyWh *StatsSeries `xml:"energy>stats"`
+}
+
+// StatsSeries is one timeseries within a DeviceStats, sampled every Grid
+// seconds.
+type StatsSeries struct {
+	// Count is the number of samples in the series, as reported by the
+	// FRITZ!Box. Values does not consult it.
+	Count int `xml:"count,attr"`
+	// Grid is the sampling interval between values, in seconds.
+	Grid int `xml:"grid,attr"`
+
+	// Raw holds the series' unparsed comma-separated samples; use
+	// Values to parse them.
+	Raw string `xml:",chardata"`
+}
+
+// Values parses the series' comma-separated samples. It returns nil if
+// s is nil or carries no samples.
+func (s *StatsSeries) Values() ([]float64, error) {
+	if s == nil || strings.TrimSpace(s.Raw) == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s.Raw, ",")
+	values := make([]float64, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
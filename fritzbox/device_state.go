@@ -0,0 +1,262 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DeviceState is a device's position in its state machine, as derived
+// from the fields most recently reported by the FRITZ!Box.
+type DeviceState int
+
+const (
+	// StateDisconnected is the state of a device the FRITZ!Box cannot
+	// currently reach.
+	StateDisconnected DeviceState = iota
+	// StateLocked is the state of a device whose switch is locked via
+	// the FRITZ!Box GUI, refusing remote commands.
+	StateLocked
+	// StateOff is a connected, unlocked socket that is switched off.
+	StateOff
+	// StateOn is a connected, unlocked socket that is switched on.
+	StateOn
+	// StateIdle is a connected, unlocked thermostat that isn't
+	// currently heating.
+	StateIdle
+	// StateHeating is a connected, unlocked thermostat that is
+	// currently heating.
+	StateHeating
+)
+
+// String returns a human readable name for s.
+func (s DeviceState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateLocked:
+		return "locked"
+	case StateOff:
+		return "off"
+	case StateOn:
+		return "on"
+	case StateIdle:
+		return "idle"
+	case StateHeating:
+		return "heating"
+	default:
+		return fmt.Sprintf("DeviceState(%d)", int(s))
+	}
+}
+
+// Event is a command or occurrence that may move a Device from one
+// DeviceState to another.
+type Event int
+
+const (
+	// EventConnect marks a device as having become reachable again.
+	EventConnect Event = iota
+	// EventDisconnect marks a device as having become unreachable.
+	EventDisconnect
+	// EventLock marks a device as locked via the FRITZ!Box GUI.
+	EventLock
+	// EventUnlock marks a device as unlocked via the FRITZ!Box GUI.
+	EventUnlock
+	// EventTurnOn requests a socket switch on, or a thermostat start
+	// heating.
+	EventTurnOn
+	// EventTurnOff requests a socket switch off, or a thermostat stop
+	// heating.
+	EventTurnOff
+	// EventToggle requests a socket flip its current switch state.
+	EventToggle
+	// EventSetSollTemperature requests a thermostat adopt a new target
+	// temperature.
+	EventSetSollTemperature
+)
+
+var (
+	// ErrLocked is returned by Transition when the device's switch is
+	// locked via the FRITZ!Box GUI.
+	ErrLocked = errors.New("fritzbox: device is locked; please unlock device via gui")
+
+	// ErrNotConnected is returned by Transition when the device is not
+	// reachable by the FRITZ!Box.
+	ErrNotConnected = errors.New("fritzbox: device is not connected")
+
+	// ErrUnsupportedCommand is returned by Transition when event is not
+	// legal from the device's current state (e.g. toggling a
+	// thermostat, or setting a soll temperature on a socket).
+	ErrUnsupportedCommand = errors.New("fritzbox: device does not support this command")
+)
+
+// transitions is the FSM's transition table: transitions[from][event]
+// gives the resulting state, if the transition is legal.
+var transitions = map[DeviceState]map[Event]DeviceState{
+	StateDisconnected: {
+		EventConnect: StateOff,
+	},
+	StateOff: {
+		EventDisconnect: StateDisconnected,
+		EventLock:       StateLocked,
+		EventTurnOn:     StateOn,
+		// EventTurnOff from StateOff is a no-op: turning off an
+		// already-off socket is idempotent, not unsupported.
+		EventTurnOff: StateOff,
+		EventToggle:  StateOn,
+	},
+	StateOn: {
+		EventDisconnect: StateDisconnected,
+		EventLock:       StateLocked,
+		EventTurnOff:    StateOff,
+		// EventTurnOn from StateOn is a no-op; see StateOff.
+		EventTurnOn: StateOn,
+		EventToggle: StateOff,
+	},
+	StateIdle: {
+		EventDisconnect: StateDisconnected,
+		EventLock:       StateLocked,
+		EventTurnOn:     StateHeating,
+		// EventTurnOff from StateIdle is a no-op; see StateOff.
+		EventTurnOff:            StateIdle,
+		EventSetSollTemperature: StateHeating,
+	},
+	StateHeating: {
+		EventDisconnect: StateDisconnected,
+		EventLock:       StateLocked,
+		EventTurnOff:    StateIdle,
+		// EventTurnOn from StateHeating is a no-op; see StateOff.
+		EventTurnOn:             StateHeating,
+		EventSetSollTemperature: StateHeating,
+	},
+	StateLocked: {
+		EventDisconnect: StateDisconnected,
+		EventUnlock:     StateOff,
+	},
+}
+
+// State derives the device's current position in the state machine from
+// its most recently reported fields.
+func (d *Device) State() DeviceState {
+	switch {
+	case !d.Connected:
+		return StateDisconnected
+	case d.Lock:
+		return StateLocked
+	case d.IsThermostat():
+		if d.SwitchState {
+			return StateHeating
+		}
+		return StateIdle
+	default:
+		if d.SwitchState {
+			return StateOn
+		}
+		return StateOff
+	}
+}
+
+// Transition validates event against the device's current State and, if
+// legal, applies the resulting state to the device's fields and notifies
+// any observers registered via DeviceService.OnTransition. It returns
+// ErrLocked, ErrNotConnected, or ErrUnsupportedCommand if event is not
+// legal from the current state.
+//
+// Transition is for callers that already know a transition has taken
+// effect (e.g. applying a diff observed from a fresh device list); it
+// applies and notifies immediately. DeviceService's own command methods
+// (TurnOnContext and friends) instead call planTransition up front and
+// commitTransition only once the FRITZ!Box has confirmed the command, so
+// a failed request can't leave Device.State() out of sync with reality.
+func (d *Device) Transition(event Event) error {
+	from, to, err := d.planTransition(event)
+	if err != nil {
+		return err
+	}
+	d.commitTransition(from, to)
+	return nil
+}
+
+// planTransition validates event against the device's current State
+// without applying it, returning the state the device would move to if
+// the caller's command goes on to succeed.
+func (d *Device) planTransition(event Event) (from, to DeviceState, err error) {
+	from = d.State()
+	to, err = checkTransition(from, event)
+	if err != nil {
+		return from, to, fmt.Errorf("device %q: %w", d.Identifier, err)
+	}
+	return from, to, nil
+}
+
+// commitTransition applies to to the device's fields and notifies any
+// observers registered via DeviceService.OnTransition. Callers must only
+// invoke it once the transition it corresponds to has actually taken
+// effect on the FRITZ!Box.
+func (d *Device) commitTransition(from, to DeviceState) {
+	d.applyState(to)
+	if d.svc != nil {
+		d.svc.notifyTransition(from, to, d)
+	}
+}
+
+// checkTransition looks event up in transitions, translating an illegal
+// transition into the most specific sentinel error for from.
+func checkTransition(from DeviceState, event Event) (DeviceState, error) {
+	if to, ok := transitions[from][event]; ok {
+		return to, nil
+	}
+
+	switch from {
+	case StateLocked:
+		return from, ErrLocked
+	case StateDisconnected:
+		return from, ErrNotConnected
+	default:
+		return from, ErrUnsupportedCommand
+	}
+}
+
+// applyState mutates a Device's fields to match it having transitioned
+// into state.
+func (d *Device) applyState(state DeviceState) {
+	switch state {
+	case StateDisconnected:
+		d.Connected = false
+	case StateLocked:
+		d.Lock = true
+	case StateOff:
+		d.Connected, d.Lock, d.SwitchState = true, false, false
+	case StateOn:
+		d.Connected, d.Lock, d.SwitchState = true, false, true
+	case StateIdle:
+		d.Connected, d.Lock, d.SwitchState = true, false, false
+	case StateHeating:
+		d.Connected, d.Lock, d.SwitchState = true, false, true
+	}
+}
+
+// OnTransition registers fn to be called, from the goroutine performing
+// the transition, whenever a Device fetched through s transitions
+// between states.
+func (s *DeviceService) OnTransition(fn func(old, new DeviceState, d *Device)) {
+	s.observersMu.Lock()
+	defer s.observersMu.Unlock()
+	s.observers = append(s.observers, fn)
+}
+
+// notifyTransition calls every observer registered via OnTransition.
+func (s *DeviceService) notifyTransition(old, new DeviceState, d *Device) {
+	s.observersMu.Lock()
+	observers := make([]func(DeviceState, DeviceState, *Device), len(s.observers))
+	copy(observers, s.observers)
+	s.observersMu.Unlock()
+
+	for _, fn := range observers {
+		fn(old, new, d)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"errors"
+	"testing"
+)
+
+var testsDeviceState = []struct {
+	Name      string
+	Connected bool
+	Lock      bool
+	BitMask   uint32
+	Switch    bool
+	Want      DeviceState
+}{
+	{
+		Name:      "disconnected",
+		Connected: false,
+		Want:      StateDisconnected,
+	},
+	{
+		Name:      "locked",
+		Connected: true,
+		Lock:      true,
+		Want:      StateLocked,
+	},
+	{
+		Name:      "socket off",
+		Connected: true,
+		BitMask:   1 << 9,
+		Switch:    false,
+		Want:      StateOff,
+	},
+	{
+		Name:      "socket on",
+		Connected: true,
+		BitMask:   1 << 9,
+		Switch:    true,
+		Want:      StateOn,
+	},
+	{
+		Name:      "thermostat idle",
+		Connected: true,
+		BitMask:   1 << 6,
+		Switch:    false,
+		Want:      StateIdle,
+	},
+	{
+		Name:      "thermostat heating",
+		Connected: true,
+		BitMask:   1 << 6,
+		Switch:    true,
+		Want:      StateHeating,
+	},
+}
+
+func TestDeviceState(t *testing.T) {
+	for _, c := range testsDeviceState {
+		t.Run(c.Name, func(t *testing.T) {
+			d := &Device{
+				Connected:       c.Connected,
+				Lock:            c.Lock,
+				FunctionBitMask: c.BitMask,
+				SwitchState:     c.Switch,
+			}
+			if got := d.State(); got != c.Want {
+				t.Errorf("State() is %v, want %v", got, c.Want)
+			}
+		})
+	}
+}
+
+var testsCheckTransition = []struct {
+	Name  string
+	From  DeviceState
+	Event Event
+	Want  DeviceState
+	Err   error
+}{
+	{Name: "off -> on", From: StateOff, Event: EventTurnOn, Want: StateOn},
+	{Name: "off -> off is a no-op", From: StateOff, Event: EventTurnOff, Want: StateOff},
+	{Name: "on -> off", From: StateOn, Event: EventTurnOff, Want: StateOff},
+	{Name: "on -> on is a no-op", From: StateOn, Event: EventTurnOn, Want: StateOn},
+	{Name: "idle -> heating", From: StateIdle, Event: EventTurnOn, Want: StateHeating},
+	{Name: "idle -> idle is a no-op", From: StateIdle, Event: EventTurnOff, Want: StateIdle},
+	{Name: "heating -> idle", From: StateHeating, Event: EventTurnOff, Want: StateIdle},
+	{Name: "heating -> heating is a no-op", From: StateHeating, Event: EventTurnOn, Want: StateHeating},
+	{Name: "locked device", From: StateLocked, Event: EventTurnOn, Err: ErrLocked},
+	{Name: "disconnected device", From: StateDisconnected, Event: EventTurnOn, Err: ErrNotConnected},
+	{Name: "toggle a thermostat", From: StateIdle, Event: EventToggle, Err: ErrUnsupportedCommand},
+	{Name: "set soll on a socket", From: StateOff, Event: EventSetSollTemperature, Err: ErrUnsupportedCommand},
+}
+
+func TestCheckTransition(t *testing.T) {
+	for _, c := range testsCheckTransition {
+		t.Run(c.Name, func(t *testing.T) {
+			got, err := checkTransition(c.From, c.Event)
+			if c.Err != nil {
+				if err != c.Err {
+					t.Fatalf("checkTransition err is %v, want %v", err, c.Err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkTransition unexpected error %v", err)
+			}
+			if got != c.Want {
+				t.Errorf("checkTransition state is %v, want %v", got, c.Want)
+			}
+		})
+	}
+}
+
+func TestDevicePlanTransitionDoesNotMutate(t *testing.T) {
+	d := &Device{Connected: true, FunctionBitMask: 1 << 9}
+
+	from, to, err := d.planTransition(EventTurnOn)
+	if err != nil {
+		t.Fatalf("planTransition unexpected error %v", err)
+	}
+	if from != StateOff || to != StateOn {
+		t.Errorf("planTransition is (%v, %v), want (%v, %v)", from, to, StateOff, StateOn)
+	}
+	if got := d.State(); got != StateOff {
+		t.Errorf("planTransition mutated device state to %v, want unchanged %v", got, StateOff)
+	}
+}
+
+func TestDeviceCommitTransitionNotifiesObservers(t *testing.T) {
+	svc := &DeviceService{}
+	d := &Device{Connected: true, FunctionBitMask: 1 << 9, svc: svc}
+
+	var gotOld, gotNew DeviceState
+	var calls int
+	svc.OnTransition(func(old, new DeviceState, observed *Device) {
+		calls++
+		gotOld, gotNew = old, new
+		if observed != d {
+			t.Errorf("OnTransition device is %v, want %v", observed, d)
+		}
+	})
+
+	from, to, err := d.planTransition(EventTurnOn)
+	if err != nil {
+		t.Fatalf("planTransition unexpected error %v", err)
+	}
+	d.commitTransition(from, to)
+
+	if calls != 1 {
+		t.Fatalf("OnTransition called %d times, want 1", calls)
+	}
+	if gotOld != StateOff || gotNew != StateOn {
+		t.Errorf("OnTransition is (%v, %v), want (%v, %v)", gotOld, gotNew, StateOff, StateOn)
+	}
+	if got := d.State(); got != StateOn {
+		t.Errorf("commitTransition State() is %v, want %v", got, StateOn)
+	}
+}
+
+func TestDeviceTransition(t *testing.T) {
+	d := &Device{Connected: true, FunctionBitMask: 1 << 9}
+
+	if err := d.Transition(EventTurnOn); err != nil {
+		t.Fatalf("Transition unexpected error %v", err)
+	}
+	if got := d.State(); got != StateOn {
+		t.Errorf("Transition State() is %v, want %v", got, StateOn)
+	}
+
+	if err := d.Transition(EventToggle); err != nil {
+		t.Fatalf("Transition unexpected error %v", err)
+	}
+	if got := d.State(); got != StateOff {
+		t.Errorf("Transition State() is %v, want %v", got, StateOff)
+	}
+}
+
+func TestDeviceTransition_illegal(t *testing.T) {
+	d := &Device{Connected: true, Lock: true}
+
+	err := d.Transition(EventTurnOn)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Transition err is %v, want wrapping %v", err, ErrLocked)
+	}
+	if got := d.State(); got != StateLocked {
+		t.Errorf("Transition on an illegal event mutated State() to %v, want unchanged %v", got, StateLocked)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testsStatsSeriesValues = []struct {
+	Name string
+	S    *StatsSeries
+	Want []float64
+	Err  bool
+}{
+	{
+		Name: "nil series",
+		S:    nil,
+		Want: nil,
+	},
+	{
+		Name: "empty raw",
+		S:    &StatsSeries{Raw: ""},
+		Want: nil,
+	},
+	{
+		Name: "whitespace-only raw",
+		S:    &StatsSeries{Raw: "  "},
+		Want: nil,
+	},
+	{
+		Name: "comma-separated values",
+		S:    &StatsSeries{Count: 3, Grid: 60, Raw: "180,190,200"},
+		Want: []float64{180, 190, 200},
+	},
+	{
+		Name: "values with surrounding whitespace",
+		S:    &StatsSeries{Raw: " 1, 2 ,3 "},
+		Want: []float64{1, 2, 3},
+	},
+	{
+		Name: "trailing comma is ignored",
+		S:    &StatsSeries{Raw: "1,2,"},
+		Want: []float64{1, 2},
+	},
+	{
+		Name: "invalid sample",
+		S:    &StatsSeries{Raw: "1,x,3"},
+		Err:  true,
+	},
+}
+
+func TestStatsSeriesValues(t *testing.T) {
+	for _, c := range testsStatsSeriesValues {
+		t.Run(c.Name, func(t *testing.T) {
+			got, err := c.S.Values()
+			if c.Err {
+				if err == nil {
+					t.Fatal("Values() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Values() unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(got, c.Want) {
+				t.Errorf("Values() is %v, want %v", got, c.Want)
+			}
+		})
+	}
+}
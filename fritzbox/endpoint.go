@@ -0,0 +1,124 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"math/rand"
+	"net/url"
+	"sync"
+)
+
+// Strategy controls how Client.PickEndpoint chooses among Client.Endpoints.
+type Strategy int
+
+const (
+	// RoundRobin cycles through Endpoints in order. It is the default.
+	RoundRobin Strategy = iota
+	// Prioritized always returns the Endpoint with the fewest recorded
+	// failures, preferring earlier entries on ties.
+	Prioritized
+	// Random picks a pseudo-random Endpoint on every call.
+	Random
+)
+
+// endpoint tracks failover bookkeeping for a single Endpoints entry.
+type endpoint struct {
+	url      *url.URL
+	failures int
+}
+
+// pool rotates across a set of candidate base URLs, recording failures so
+// Strategy can steer away from unhealthy endpoints.
+type pool struct {
+	mu      sync.Mutex
+	entries []*endpoint
+	index   int
+	active  *url.URL
+}
+
+func newPool() *pool {
+	return &pool{}
+}
+
+// pick selects the next endpoint according to strategy and records it as
+// the active one.
+func (p *pool) pick(strategy Strategy, urls []*url.URL) *url.URL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.syncLocked(urls)
+	if len(p.entries) == 0 {
+		return nil
+	}
+
+	var e *endpoint
+	switch strategy {
+	case Prioritized:
+		e = p.entries[0]
+		for _, c := range p.entries[1:] {
+			if c.failures < e.failures {
+				e = c
+			}
+		}
+	case Random:
+		e = p.entries[rand.Intn(len(p.entries))]
+	default: // RoundRobin
+		e = p.entries[p.index%len(p.entries)]
+		p.index++
+	}
+
+	p.active = e.url
+	return e.url
+}
+
+// current returns the endpoint returned by the most recent pick, if any.
+func (p *pool) current() *url.URL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// recordFailure increments the failure count of u, if it is a known
+// endpoint.
+func (p *pool) recordFailure(u *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		if e.url.String() == u.String() {
+			e.failures++
+			return
+		}
+	}
+}
+
+// syncLocked rebuilds entries when the candidate list changes, keeping
+// failure counts for URLs that are still present.
+func (p *pool) syncLocked(urls []*url.URL) {
+	if len(p.entries) == len(urls) {
+		same := true
+		for i, u := range urls {
+			if p.entries[i].url.String() != u.String() {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+
+	prev := make(map[string]int, len(p.entries))
+	for _, e := range p.entries {
+		prev[e.url.String()] = e.failures
+	}
+
+	entries := make([]*endpoint, len(urls))
+	for i, u := range urls {
+		entries[i] = &endpoint{url: u, failures: prev[u.String()]}
+	}
+	p.entries = entries
+	p.index = 0
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// defaultPollInterval is used by Subscribe when WithPollInterval is
+	// not given.
+	defaultPollInterval = 30 * time.Second
+
+	// minPollInterval is the smallest interval Subscribe honors,
+	// clamping anything lower in order to protect the FRITZ!Box from
+	// being hammered.
+	minPollInterval = 10 * time.Second
+
+	// eventBufferSize is the capacity of the channel returned by
+	// Subscribe. Once full, the oldest pending event is dropped to make
+	// room, so a slow consumer cannot wedge the poller.
+	eventBufferSize = 64
+)
+
+// DeviceEvent is implemented by every event type emitted by
+// DeviceService.Subscribe. Consumers type-switch on the concrete type
+// (DeviceAdded, DeviceRemoved, TemperatureChanged, SwitchStateChanged,
+// PresenceChanged) to inspect it.
+type DeviceEvent interface {
+	// AIN returns the identifier of the device the event is about.
+	AIN() string
+	// Occurred returns the time the event was observed.
+	Occurred() time.Time
+}
+
+// event holds the fields common to every DeviceEvent.
+type event struct {
+	ain       string
+	Timestamp time.Time
+}
+
+// AIN implements DeviceEvent.
+func (e event) AIN() string { return e.ain }
+
+// Occurred implements DeviceEvent.
+func (e event) Occurred() time.Time { return e.Timestamp }
+
+// DeviceAdded is emitted the first time a device appears in the device
+// list after Subscribe was called.
+type DeviceAdded struct {
+	event
+	Device *Device
+}
+
+// DeviceRemoved is emitted when a previously known device disappears
+// from the device list.
+type DeviceRemoved struct {
+	event
+	Device *Device
+}
+
+// TemperatureChanged is emitted when a device's reported temperature
+// changes.
+type TemperatureChanged struct {
+	event
+	Old, New float64
+}
+
+// SwitchStateChanged is emitted when a socket is switched on or off.
+type SwitchStateChanged struct {
+	event
+	Old, New bool
+}
+
+// PresenceChanged is emitted when a device connects to or disconnects
+// from the FRITZ!Box mesh.
+type PresenceChanged struct {
+	event
+	Old, New bool
+}
+
+// SubscribeOption configures Subscribe.
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	interval time.Duration
+}
+
+// WithPollInterval sets the interval at which Subscribe polls the device
+// list. It is clamped to minPollInterval.
+func WithPollInterval(d time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.interval = d
+	}
+}
+
+// Subscribe emits a DeviceEvent for every change EventService observes in
+// the device list, until ctx is cancelled, at which point the returned
+// channel is closed. The channel is buffered; once full, the oldest
+// pending event is dropped to make room for the newest one, so a slow
+// consumer cannot wedge the poller.
+//
+// Subscribe is a DeviceEvent-shaped view onto s.c.EventService, so a
+// Client only ever runs one device-list poller no matter how many
+// callers use Subscribe, Run, or both: it starts EventService.Run if
+// nothing else has, tolerating ErrEventServiceRunning when something
+// already has. Power changes are not emitted as DeviceEvents: EventService
+// reports power only as EventPowerThresholdCrossed, gated by
+// EventService.PowerThreshold, and Subscribe does not translate those.
+func (s *DeviceService) Subscribe(ctx context.Context, opts ...SubscribeOption) (<-chan DeviceEvent, error) {
+	cfg := subscribeConfig{interval: defaultPollInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.interval < minPollInterval {
+		cfg.interval = minPollInterval
+	}
+
+	// Best effort: if Run is already running (ErrEventServiceRunning) this
+	// Subscription rides along with it; if Run itself fails for some
+	// other reason, Subscribe has no side channel to report that on, so
+	// the Subscription simply never receives anything.
+	go s.c.EventService.Run(ctx, WithEventPollInterval(cfg.interval))
+
+	sub := s.c.EventService.Subscribe(EventMaskAll)
+
+	events := make(chan DeviceEvent, eventBufferSize)
+	go translateEvents(ctx, sub, events)
+
+	return events, nil
+}
+
+// translateEvents runs until ctx is cancelled or sub.C is closed,
+// forwarding each TelemetryEvent it can translate into the corresponding
+// DeviceEvent.
+func translateEvents(ctx context.Context, sub *Subscription, events chan DeviceEvent) {
+	defer close(events)
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case te, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if de := translateEvent(te); de != nil {
+				emitEvent(events, de)
+			}
+		}
+	}
+}
+
+// translateEvent converts a TelemetryEvent into the equivalent
+// DeviceEvent, or returns nil if te has no DeviceEvent equivalent.
+func translateEvent(te TelemetryEvent) DeviceEvent {
+	base := event{ain: te.AIN, Timestamp: te.Time}
+
+	switch data := te.Data.(type) {
+	case *Device:
+		switch te.Type {
+		case EventDeviceAdded:
+			return DeviceAdded{event: base, Device: data}
+		case EventDeviceRemoved:
+			return DeviceRemoved{event: base, Device: data}
+		}
+	case ConnectivityChangedData:
+		return PresenceChanged{event: base, Old: data.Old, New: data.New}
+	case SwitchChangedData:
+		return SwitchStateChanged{event: base, Old: data.Old, New: data.New}
+	case TemperatureChangedData:
+		return TemperatureChanged{event: base, Old: data.Old, New: data.New}
+	}
+	return nil
+}
+
+// emitEvent sends e on events, dropping the oldest pending event to make
+// room if the channel is full.
+func emitEvent(events chan DeviceEvent, e DeviceEvent) {
+	select {
+	case events <- e:
+		return
+	default:
+	}
+
+	select {
+	case <-events:
+	default:
+	}
+
+	select {
+	case events <- e:
+	default:
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultEventPollInterval is used by Run when WithEventPollInterval
+	// is not given.
+	defaultEventPollInterval = 30 * time.Second
+
+	// minEventPollInterval is the smallest interval Run honors, clamping
+	// anything lower in order to protect the FRITZ!Box from being
+	// hammered.
+	minEventPollInterval = 10 * time.Second
+
+	// maxEventBackoff caps how far Run backs off the poll interval after
+	// consecutive failures.
+	maxEventBackoff = 5 * time.Minute
+
+	// defaultDebounceWindow is used when EventService.DebounceWindow is
+	// zero.
+	defaultDebounceWindow = 5 * time.Second
+
+	// defaultRingSize is used when EventService.RingSize is zero.
+	defaultRingSize = 256
+
+	// eventSubBufferSize is the capacity of the channel returned by
+	// Subscribe. Once full, the oldest pending event is dropped to make
+	// room, so a slow consumer cannot wedge the poller.
+	eventSubBufferSize = 64
+)
+
+// ErrEventServiceRunning is returned by Run when it is called while
+// another call to Run on the same EventService is already in flight, as
+// happens when both DeviceService.Subscribe and an explicit Run call try
+// to drive the same Client's EventService.
+var ErrEventServiceRunning = errors.New("fritzbox: EventService.Run is already running")
+
+// EventType identifies the kind of change an Event reports, and doubles
+// as a single-bit EventMask for Subscribe.
+type EventType uint32
+
+const (
+	// EventDeviceAdded is emitted the first time a device appears in
+	// the device list after Run was started.
+	EventDeviceAdded EventType = 1 << iota
+	// EventDeviceRemoved is emitted when a previously known device
+	// disappears from the device list.
+	EventDeviceRemoved
+	// EventConnectivityChanged is emitted when a device connects to or
+	// disconnects from the FRITZ!Box mesh.
+	EventConnectivityChanged
+	// EventSwitchChanged is emitted when a socket is switched on or
+	// off.
+	EventSwitchChanged
+	// EventTemperatureChanged is emitted when a device's reported
+	// temperature changes.
+	EventTemperatureChanged
+	// EventPowerThresholdCrossed is emitted when a socket's power draw
+	// crosses EventService.PowerThreshold, in either direction.
+	EventPowerThresholdCrossed
+	// EventSollTemperatureChanged is emitted when a thermostat's target
+	// temperature changes.
+	EventSollTemperatureChanged
+
+	// EventMaskAll matches every EventType.
+	EventMaskAll = EventDeviceAdded | EventDeviceRemoved | EventConnectivityChanged |
+		EventSwitchChanged | EventTemperatureChanged | EventPowerThresholdCrossed |
+		EventSollTemperatureChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventDeviceAdded:
+		return "DeviceAdded"
+	case EventDeviceRemoved:
+		return "DeviceRemoved"
+	case EventConnectivityChanged:
+		return "ConnectivityChanged"
+	case EventSwitchChanged:
+		return "SwitchChanged"
+	case EventTemperatureChanged:
+		return "TemperatureChanged"
+	case EventPowerThresholdCrossed:
+		return "PowerThresholdCrossed"
+	case EventSollTemperatureChanged:
+		return "SollTemperatureChanged"
+	default:
+		return "EventType(" + strconv.FormatUint(uint64(t), 10) + ")"
+	}
+}
+
+// EventMask selects which EventTypes a Subscription receives. Combine
+// EventTypes with | to match more than one.
+type EventMask = EventType
+
+// TelemetryEvent is a single occurrence dispatched by EventService,
+// modeled after syncthing's events API: a monotonically increasing ID,
+// a timestamp, the AIN of the device it concerns, and a Type-dependent
+// Data payload.
+//
+// Data holds *Device for EventDeviceAdded/EventDeviceRemoved, and one of
+// ConnectivityChangedData, SwitchChangedData, TemperatureChangedData,
+// PowerThresholdCrossedData, or SollTemperatureChangedData otherwise.
+type TelemetryEvent struct {
+	ID   int64
+	Time time.Time
+	Type EventType
+	AIN  string
+	Data interface{}
+}
+
+// ConnectivityChangedData is the Data of an EventConnectivityChanged
+// Event.
+type ConnectivityChangedData struct{ Old, New bool }
+
+// SwitchChangedData is the Data of an EventSwitchChanged Event.
+type SwitchChangedData struct{ Old, New bool }
+
+// TemperatureChangedData is the Data of an EventTemperatureChanged
+// Event, in degrees Celsius.
+type TemperatureChangedData struct{ Old, New float64 }
+
+// SollTemperatureChangedData is the Data of an
+// EventSollTemperatureChanged Event, in degrees Celsius.
+type SollTemperatureChangedData struct{ Old, New float64 }
+
+// PowerThresholdCrossedData is the Data of an EventPowerThresholdCrossed
+// Event. PowerMW is the power draw, in milliwatts, that crossed
+// Threshold; Above reports the direction of the crossing.
+type PowerThresholdCrossedData struct {
+	Threshold, PowerMW int64
+	Above              bool
+}
+
+// EventService polls DeviceService.List on a configurable interval,
+// diffs successive snapshots, and dispatches a typed TelemetryEvent for
+// every change it observes to every matching Subscription.
+type EventService struct {
+	c *Client
+
+	// PowerThreshold is the power draw, in milliwatts, at which
+	// EventPowerThresholdCrossed fires as a device's power crosses it
+	// in either direction. Zero disables the event.
+	PowerThreshold int64
+
+	// DebounceWindow suppresses repeated events of the same EventType
+	// for the same device within the window, so a burst of identical
+	// readings emits only one Event. Zero uses defaultDebounceWindow.
+	DebounceWindow time.Duration
+
+	// RingSize bounds how many past Events Since can replay. Zero uses
+	// defaultRingSize.
+	RingSize int
+
+	mu       sync.Mutex
+	running  bool
+	nextID   int64
+	ring     []TelemetryEvent
+	lastSeen map[string]time.Time
+	subs     map[int64]*eventSub
+	nextSub  int64
+}
+
+// eventSub is a single Subscription's channel and interest mask.
+type eventSub struct {
+	mask EventMask
+	ch   chan TelemetryEvent
+}
+
+// Subscription is a live registration against an EventService, created
+// by Subscribe.
+type Subscription struct {
+	svc  *EventService
+	id   int64
+	mask EventMask
+
+	// C delivers Events matching mask as they are emitted. C is never
+	// closed; stop reading from it after calling Close.
+	C <-chan TelemetryEvent
+}
+
+// Subscribe registers a new Subscription that receives Events of the
+// types set in mask. Run must be running (in another goroutine) for any
+// Events to arrive.
+func (s *EventService) Subscribe(mask EventMask) *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subs == nil {
+		s.subs = make(map[int64]*eventSub)
+	}
+	s.nextSub++
+	id := s.nextSub
+	ch := make(chan TelemetryEvent, eventSubBufferSize)
+	s.subs[id] = &eventSub{mask: mask, ch: ch}
+
+	return &Subscription{svc: s, id: id, mask: mask, C: ch}
+}
+
+// Close unregisters sub. After Close returns, sub.C receives no further
+// Events.
+func (sub *Subscription) Close() {
+	sub.svc.mu.Lock()
+	defer sub.svc.mu.Unlock()
+	delete(sub.svc.subs, sub.id)
+}
+
+// Since returns Events matching sub's mask with an ID greater than id,
+// replaying from the bounded ring buffer kept by sub's EventService.
+// Events older than the buffer's capacity are no longer available.
+func (sub *Subscription) Since(id int64) []TelemetryEvent {
+	return sub.svc.since(id, sub.mask)
+}
+
+func (s *EventService) since(id int64, mask EventMask) []TelemetryEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []TelemetryEvent
+	for _, e := range s.ring {
+		if e.ID > id && e.Type&mask != 0 {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// EventRunOption configures Run.
+type EventRunOption func(*eventRunConfig)
+
+type eventRunConfig struct {
+	interval time.Duration
+}
+
+// WithEventPollInterval sets the interval at which Run polls the device
+// list. It is clamped to minEventPollInterval.
+func WithEventPollInterval(d time.Duration) EventRunOption {
+	return func(c *eventRunConfig) {
+		c.interval = d
+	}
+}
+
+// Run polls the AHA-HTTP device list on a configurable interval and
+// dispatches an Event to every matching Subscription for each change it
+// observes, until ctx is cancelled, at which point Run returns
+// ctx.Err(). If the initial snapshot of the device list cannot be
+// fetched, Run returns that error straight away. On a later poll
+// failure, Run backs off the interval exponentially up to
+// maxEventBackoff, so a struggling FRITZ!Box isn't hammered; the
+// interval resets to normal as soon as a poll succeeds.
+//
+// Run is typically started in its own goroutine and kept running for
+// the lifetime of the Client. Calling Run again while another call is
+// already in flight returns ErrEventServiceRunning instead of starting a
+// second poller; DeviceService.Subscribe relies on this to share a
+// single poll loop with an explicitly started Run.
+func (s *EventService) Run(ctx context.Context, opts ...EventRunOption) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return ErrEventServiceRunning
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	cfg := eventRunConfig{interval: defaultEventPollInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.interval < minEventPollInterval {
+		cfg.interval = minEventPollInterval
+	}
+
+	devices, err := s.c.DeviceService.ListContext(ctx)
+	if err != nil {
+		return err
+	}
+	last := make(map[string]*Device, len(devices))
+	for _, d := range devices {
+		last[cleanAin(d.Identifier)] = d
+	}
+
+	backoff := cfg.interval
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-timer.C:
+			devices, err := s.c.DeviceService.ListContext(ctx)
+			if err != nil {
+				backoff *= 2
+				if backoff > maxEventBackoff {
+					backoff = maxEventBackoff
+				}
+				timer.Reset(backoff)
+				continue
+			}
+			backoff = cfg.interval
+
+			seen := make(map[string]bool, len(devices))
+			for _, d := range devices {
+				ain := cleanAin(d.Identifier)
+				seen[ain] = true
+
+				if old, ok := last[ain]; ok {
+					s.diff(old, d, now)
+				} else {
+					s.emit(EventDeviceAdded, ain, d, now)
+				}
+				last[ain] = d
+			}
+
+			for ain, d := range last {
+				if seen[ain] {
+					continue
+				}
+				s.emit(EventDeviceRemoved, ain, d, now)
+				delete(last, ain)
+			}
+
+			timer.Reset(backoff)
+		}
+	}
+}
+
+// diff emits an Event for every observable difference between old and
+// next, which are snapshots of the same device from successive polls.
+func (s *EventService) diff(old, next *Device, now time.Time) {
+	ain := cleanAin(next.Identifier)
+
+	if old.Connected != next.Connected {
+		s.emit(EventConnectivityChanged, ain, ConnectivityChangedData{old.Connected, next.Connected}, now)
+	}
+	if old.SwitchState != next.SwitchState {
+		s.emit(EventSwitchChanged, ain, SwitchChangedData{old.SwitchState, next.SwitchState}, now)
+	}
+	if old.TemperatureCelsius != next.TemperatureCelsius {
+		s.emit(EventTemperatureChanged, ain, TemperatureChangedData{
+			float64(old.TemperatureCelsius) / 10,
+			float64(next.TemperatureCelsius) / 10,
+		}, now)
+	}
+	if old.SollTemperatureRaw != next.SollTemperatureRaw {
+		s.emit(EventSollTemperatureChanged, ain, SollTemperatureChangedData{
+			float64(old.SollTemperatureRaw) / 2,
+			float64(next.SollTemperatureRaw) / 2,
+		}, now)
+	}
+	if threshold := s.PowerThreshold; threshold > 0 {
+		wasAbove := old.PowerMW >= threshold
+		isAbove := next.PowerMW >= threshold
+		if wasAbove != isAbove {
+			s.emit(EventPowerThresholdCrossed, ain, PowerThresholdCrossedData{threshold, next.PowerMW, isAbove}, now)
+		}
+	}
+}
+
+// emit assigns the next ID to a new Event, appends it to the ring
+// buffer, and fans it out to every Subscription whose mask matches,
+// unless an Event of the same type for the same device was already
+// emitted within DebounceWindow.
+func (s *EventService) emit(t EventType, ain string, data interface{}, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	debounce := s.DebounceWindow
+	if debounce <= 0 {
+		debounce = defaultDebounceWindow
+	}
+	key := ain + ":" + t.String()
+	if last, ok := s.lastSeen[key]; ok && now.Sub(last) < debounce {
+		return
+	}
+	if s.lastSeen == nil {
+		s.lastSeen = make(map[string]time.Time)
+	}
+	s.lastSeen[key] = now
+
+	ringSize := s.RingSize
+	if ringSize <= 0 {
+		ringSize = defaultRingSize
+	}
+
+	s.nextID++
+	e := TelemetryEvent{ID: s.nextID, Time: now, Type: t, AIN: ain, Data: data}
+
+	s.ring = append(s.ring, e)
+	if len(s.ring) > ringSize {
+		s.ring = s.ring[len(s.ring)-ringSize:]
+	}
+
+	for _, sub := range s.subs {
+		if e.Type&sub.mask == 0 {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+			continue
+		default:
+		}
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
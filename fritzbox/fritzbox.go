@@ -6,19 +6,40 @@
 package fritzbox
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 const (
 	defaultBaseURL = "http://fritz.box/"
 )
 
+// ErrEndpointNotAuthenticated is returned by DoWithContext when failover
+// would retry a request from an Endpoint that has a Session against an
+// Endpoint that has no Session yet.
+// Call AuthContext against that Endpoint (PickEndpoint/Endpoint report
+// which one is now active) before retrying.
+var ErrEndpointNotAuthenticated = errors.New("fritzbox: next endpoint has no session; call AuthContext against it before retrying")
+
+// requestInfoKey is the context key under which NewRequestWithContext
+// stashes the inputs it used to build a request, so DoWithContext can
+// rebuild an equivalent request against a different Endpoint on failover.
+type requestInfoKey struct{}
+
+type requestInfo struct {
+	method string
+	urlStr string
+	data   url.Values
+}
+
 // A Client manages communication with the FRITZ!Box
 type Client struct {
 	// HTTP client used to communicate with the FRITZ!Box
@@ -27,13 +48,59 @@ type Client struct {
 	// Base URL for requests. Defaults to the local fritzbox, but
 	// can be set to a domain endpoint to use with an external FRITZ!Box.
 	// BaseURL should always be specified with a trailing slash.
+	//
+	// BaseURL is only consulted when Endpoints is empty.
 	BaseURL *url.URL
 
-	// Session used to authenticate client
+	// Endpoints, when non-empty, is a pool of FRITZ!Box base URLs (e.g. a
+	// local box and a MyFRITZ! DDNS address, or a primary plus a mesh
+	// repeater) that Client fails over between. On a transport error or
+	// 5xx response, Do pins to the next Endpoint chosen by Strategy and
+	// retries the request; non-GET requests are only retried if
+	// AllowUnsafeRetry is set. Each Endpoint keeps its own Session, since
+	// FRITZ!Box SIDs are not valid across boxes; failover does not
+	// authenticate a new Endpoint on the caller's behalf, so failing over
+	// to one AuthContext has never been called against returns
+	// ErrEndpointNotAuthenticated rather than retrying unauthenticated.
+	Endpoints []*url.URL
+
+	// Strategy selects how PickEndpoint rotates through Endpoints.
+	Strategy Strategy
+
+	// AllowUnsafeRetry permits Do to retry non-idempotent requests
+	// against the next Endpoint after a failure. Left false, only GETs
+	// are retried.
+	AllowUnsafeRetry bool
+
+	pool *pool
+
+	// Session used to authenticate client against BaseURL. Only used
+	// when Endpoints is empty; see sessions otherwise.
 	session *Session
 
+	mu sync.Mutex
+	// sessions holds one Session per Endpoint, keyed by its string form.
+	sessions map[string]*Session
+
 	// deviceService ...
 	DeviceService *DeviceService
+
+	// TR064 talks to the FRITZ!Box's TR-064 SOAP interface, a sibling
+	// API to DeviceService's AHA-HTTP. Set TR064.Username/Password
+	// before use.
+	TR064 *TR064Service
+
+	// EventService polls DeviceService on a configurable interval and
+	// dispatches typed Events to Subscribers. Run must be called to
+	// start polling. Set PowerThreshold/DebounceWindow/RingSize before
+	// calling Run, if the defaults don't fit.
+	EventService *EventService
+
+	// GroupService handles device groups.
+	GroupService *GroupService
+
+	// TemplateService handles templates.
+	TemplateService *TemplateService
 }
 
 // NewClient returns a new FRITZ!Box client. If a nil httpClient is
@@ -49,32 +116,94 @@ func NewClient(httpClient *http.Client) *Client {
 	baseURL, _ := url.Parse(defaultBaseURL)
 
 	c := &Client{
-		client:  httpClient,
-		BaseURL: baseURL,
+		client:   httpClient,
+		BaseURL:  baseURL,
+		pool:     newPool(),
+		sessions: make(map[string]*Session),
 	}
 
 	c.DeviceService = &DeviceService{c: c}
+	c.TR064 = &TR064Service{c: c}
+	c.EventService = &EventService{c: c}
+	c.GroupService = &GroupService{c: c}
+	c.TemplateService = &TemplateService{c: c}
 
 	return c
 }
 
-// NewRequest creates an API request. A relative URL can be provided
-// in urlStr in which case it is resolved relative to the BaseURL of
-// the Client. Relative URLs should always be specified without a
-// preceding slash. If specified, the value pointed to by data is Query
-// encoded and included as the request body in order to perform form requests.
+// PickEndpoint selects the next Endpoint according to Strategy and
+// records it as the active one. If Endpoints is empty, it returns
+// BaseURL.
+func (c *Client) PickEndpoint() *url.URL {
+	if len(c.Endpoints) == 0 {
+		return c.BaseURL
+	}
+	return c.pool.pick(c.Strategy, c.Endpoints)
+}
+
+// Endpoint returns the currently active base URL, i.e. the one the last
+// request was (or the next request will be) sent to.
+func (c *Client) Endpoint() *url.URL {
+	if len(c.Endpoints) == 0 {
+		return c.BaseURL
+	}
+	if u := c.pool.current(); u != nil {
+		return u
+	}
+	return c.PickEndpoint()
+}
+
+// sessionFor returns the Session associated with endpoint, if any.
+func (c *Client) sessionFor(endpoint *url.URL) *Session {
+	if len(c.Endpoints) == 0 {
+		return c.session
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions[endpoint.String()]
+}
+
+// setSessionFor associates s with endpoint.
+func (c *Client) setSessionFor(endpoint *url.URL, s *Session) {
+	if len(c.Endpoints) == 0 {
+		c.session = s
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[endpoint.String()] = s
+}
+
+// NewRequest creates an API request. It is equivalent to
+// NewRequestWithContext with context.Background().
 func (c *Client) NewRequest(method, urlStr string,
+	data url.Values) (*http.Request, error) {
+	return c.NewRequestWithContext(context.Background(), method, urlStr, data)
+}
+
+// NewRequestWithContext creates an API request bound to ctx. A relative URL
+// can be provided in urlStr in which case it is resolved relative to the
+// Client's active Endpoint (or BaseURL). Relative URLs should always be
+// specified without a preceding slash. If specified, the value pointed to
+// by data is Query encoded and included as the request body in order to
+// perform form requests.
+func (c *Client) NewRequestWithContext(ctx context.Context, method, urlStr string,
 	data url.Values) (*http.Request, error) {
 	rel, err := url.Parse(urlStr)
 	if err != nil {
 		return nil, err
 	}
 
-	u := c.BaseURL.ResolveReference(rel)
+	base := c.Endpoint()
+	if base == nil {
+		return nil, errors.New("fritzbox: no endpoint configured")
+	}
+
+	u := base.ResolveReference(rel)
 
-	if c.session != nil {
+	if s := c.sessionFor(base); s != nil {
 		values := u.Query()
-		values.Set("sid", c.session.Sid)
+		values.Set("sid", s.Sid)
 		u.RawQuery = values.Encode()
 	}
 
@@ -82,72 +211,152 @@ func (c *Client) NewRequest(method, urlStr string,
 	if data != nil {
 		buf = strings.NewReader(data.Encode())
 	}
-	req, err := http.NewRequest(method, u.String(), buf)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
+	ctx = context.WithValue(ctx, requestInfoKey{}, requestInfo{
+		method: method,
+		urlStr: urlStr,
+		data:   data,
+	})
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), buf)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
 	return req, nil
 }
 
-// Do sends a request and returns the response. The response is
-// either JSON decoded or XML encoded and stored in the value
-// pointed to by v, or returned as an error, if any.
+// Do sends a request and returns the response. It is equivalent to
+// DoWithContext with req's context.
 func (c *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
-	if c.session != nil {
-		if err := c.session.Refresh(); err != nil {
-			return nil, err
-		}
-	}
+	return c.DoWithContext(req.Context(), req, v)
+}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
+// DoWithContext sends a request and returns the response. The response is
+// either JSON decoded or XML encoded and stored in the value pointed to by
+// v, or returned as an error, if any. If ctx is cancelled or its deadline
+// exceeded while the request is in flight, DoWithContext returns ctx.Err()
+// rather than the wrapped transport error.
+//
+// If the Client has more than one Endpoint, a transport error or 5xx
+// response pins to the next Endpoint (chosen by Strategy) and retries the
+// request; non-GET requests are only retried if AllowUnsafeRetry is set.
+func (c *Client) DoWithContext(ctx context.Context, req *http.Request, v interface{}) (*http.Response, error) {
+	endpoint := c.Endpoint()
+	info, _ := req.Context().Value(requestInfoKey{}).(requestInfo)
+
+	attempts := len(c.Endpoints)
+	if attempts < 1 {
+		attempts = 1
 	}
 
-	defer resp.Body.Close()
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if s := c.sessionFor(endpoint); s != nil {
+			if err := s.RefreshContext(ctx); err != nil {
+				return nil, err
+			}
+		}
 
-	if c := resp.StatusCode; 200 < c && c > 299 {
-		return nil, errors.New("Wrong status code")
-	}
+		resp, err := c.client.Do(req)
+		switch {
+		case err != nil:
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			lastErr = err
+		case resp.StatusCode >= 500:
+			resp.Body.Close()
+			lastErr = fmt.Errorf("fritzbox: endpoint %s returned %s", endpoint, resp.Status)
+		default:
+			defer resp.Body.Close()
+
+			if sc := resp.StatusCode; 200 < sc && sc > 299 {
+				return nil, errors.New("Wrong status code")
+			}
 
-	contentType := resp.Header.Get("Content-Type")
+			contentType := resp.Header.Get("Content-Type")
 
-	if v != nil {
-		if w, ok := v.(io.Writer); ok {
-			_, err = io.Copy(w, resp.Body)
+			if v != nil {
+				if w, ok := v.(io.Writer); ok {
+					_, err = io.Copy(w, resp.Body)
 
-		} else {
-			if strings.Contains(contentType, "text/xml") {
-				err = xml.NewDecoder(resp.Body).Decode(v)
-			}
-			if strings.Contains(contentType, "application/json") {
-				err = json.NewDecoder(resp.Body).Decode(v)
+				} else {
+					if strings.Contains(contentType, "text/xml") {
+						err = xml.NewDecoder(resp.Body).Decode(v)
+					}
+					if strings.Contains(contentType, "application/json") {
+						err = json.NewDecoder(resp.Body).Decode(v)
+					}
+
+				}
 			}
 
+			return resp, err
+		}
+
+		if attempt == attempts-1 || info.method == "" {
+			return nil, lastErr
 		}
+		if req.Method != http.MethodGet && !c.AllowUnsafeRetry {
+			return nil, lastErr
+		}
+
+		c.pool.recordFailure(endpoint)
+		next := c.PickEndpoint()
+		if next == nil || next.String() == endpoint.String() {
+			return nil, lastErr
+		}
+
+		// Don't silently retry an authenticated request against an
+		// Endpoint that has no Session: it would go out without a sid,
+		// the FRITZ!Box would reject it, and the caller would see a
+		// confusing "Wrong status code" instead of a clear signal that
+		// it needs to AuthContext against the new Endpoint first.
+		if c.sessionFor(endpoint) != nil && c.sessionFor(next) == nil {
+			return nil, ErrEndpointNotAuthenticated
+		}
+		endpoint = next
+
+		newReq, rerr := c.NewRequestWithContext(req.Context(), info.method, info.urlStr, info.data)
+		if rerr != nil {
+			return nil, rerr
+		}
+		req = newReq
 	}
 
-	return resp, err
+	return nil, lastErr
 }
 
-// Auth sends a auth request and returns an error, if any. Session is stored
-// in client in order to perform requests with authentification.
+// Auth sends a auth request. It is equivalent to AuthContext with
+// context.Background().
 func (c *Client) Auth(username, password string) error {
-	var s *Session
-	if c.session == nil {
+	return c.AuthContext(context.Background(), username, password)
+}
+
+// AuthContext sends a auth request bound to ctx and returns an error, if
+// any. Session is stored in client, keyed by the active Endpoint, in
+// order to perform requests with authentification. On failover to a
+// different Endpoint, callers must call AuthContext again so the new
+// box's SID is obtained; DoWithContext does not do this automatically
+// and returns ErrEndpointNotAuthenticated instead.
+func (c *Client) AuthContext(ctx context.Context, username, password string) error {
+	endpoint := c.Endpoint()
+	if endpoint == nil {
+		return errors.New("fritzbox: no endpoint configured")
+	}
+
+	s := c.sessionFor(endpoint)
+	if s == nil {
 		s = NewSession(c)
-		c.session = s
-	} else {
-		s = c.session
+		c.setSessionFor(endpoint, s)
 	}
 
-	if err := s.Open(); err != nil {
+	if err := s.OpenContext(ctx); err != nil {
 		return err
 	}
 
-	if err := s.Auth(username, password); err != nil {
+	if err := s.AuthContext(ctx, username, password); err != nil {
 		return err
 	}
 
@@ -156,9 +365,14 @@ func (c *Client) Auth(username, password string) error {
 
 // Close closes the current session
 func (c *Client) Close() {
-	c.session.Close()
+	if s := c.sessionFor(c.Endpoint()); s != nil {
+		s.Close()
+	}
 }
 
 func (c *Client) String() string {
-	return c.session.String()
+	if s := c.sessionFor(c.Endpoint()); s != nil {
+		return s.String()
+	}
+	return ""
 }
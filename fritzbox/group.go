@@ -0,0 +1,57 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+)
+
+// GroupService handles fritz!Box device groups, returned alongside
+// devices by getdevicelistinfos.
+type GroupService struct {
+	c *Client
+}
+
+// Group represents a group of devices, such as the ones configured via
+// "Smart Home" > "Gruppen" in the FRITZ!Box UI.
+type Group struct {
+	XMLName         xml.Name `xml:"group"`
+	Identifier      string   `xml:"identifier,attr"`
+	FunctionBitMask uint32   `xml:"functionbitmask,attr"`
+	Name            string   `xml:"name"`
+
+	// Members is the comma-separated list of member AINs, as returned
+	// by the FRITZ!Box. Use MemberAINs to parse it.
+	Members string `xml:"groupinfo>members"`
+}
+
+// MemberAINs returns the group's member device identifiers.
+func (g *Group) MemberAINs() []string {
+	var ains []string
+	for _, ain := range strings.Split(g.Members, ",") {
+		if ain = strings.TrimSpace(ain); ain != "" {
+			ains = append(ains, ain)
+		}
+	}
+	return ains
+}
+
+// List returns a list of all groups. It is equivalent to ListContext
+// with context.Background().
+func (s *GroupService) List() ([]*Group, error) {
+	return s.ListContext(context.Background())
+}
+
+// ListContext returns a list of all groups, bound to ctx.
+func (s *GroupService) ListContext(ctx context.Context) ([]*Group, error) {
+	list, err := s.c.DeviceService.fetchDeviceList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return list.Groups, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// BlindTarget is the position SetBlind drives a blind/shutter towards.
+type BlindTarget string
+
+const (
+	// BlindOpen fully opens a blind.
+	BlindOpen BlindTarget = "open"
+	// BlindClose fully closes a blind.
+	BlindClose BlindTarget = "close"
+	// BlindStop halts a blind wherever it currently is.
+	BlindStop BlindTarget = "stop"
+)
+
+func lightingPrecheck(d *Device, supported bool) error {
+	if err := precheck(d, true); err != nil {
+		return err
+	}
+	if !supported {
+		return fmt.Errorf("device %q does not support this command", d.Identifier)
+	}
+	return nil
+}
+
+// SetLevel sets a color bulb's absolute brightness, in the range 0-255.
+// It is equivalent to SetLevelContext with context.Background().
+func (s *DeviceService) SetLevel(d *Device, level uint8) error {
+	return s.SetLevelContext(context.Background(), d, level)
+}
+
+// SetLevelContext sets a color bulb's absolute brightness, in the range
+// 0-255, bound to ctx.
+func (s *DeviceService) SetLevelContext(ctx context.Context, d *Device, level uint8) error {
+	if err := lightingPrecheck(d, d.IsColorBulb()); err != nil {
+		return err
+	}
+	return s.sendCommand(ctx, "setlevel", map[string]string{
+		"ain":   cleanAin(d.Identifier),
+		"level": fmt.Sprintf("%d", level),
+	})
+}
+
+// SetLevelPercentage sets a color bulb's brightness, as a percentage
+// from 0-100. It is equivalent to SetLevelPercentageContext with
+// context.Background().
+func (s *DeviceService) SetLevelPercentage(d *Device, percent uint8) error {
+	return s.SetLevelPercentageContext(context.Background(), d, percent)
+}
+
+// SetLevelPercentageContext sets a color bulb's brightness, as a
+// percentage from 0-100, bound to ctx.
+func (s *DeviceService) SetLevelPercentageContext(ctx context.Context, d *Device, percent uint8) error {
+	if err := lightingPrecheck(d, d.IsColorBulb()); err != nil {
+		return err
+	}
+	return s.sendCommand(ctx, "setlevelpercentage", map[string]string{
+		"ain":   cleanAin(d.Identifier),
+		"level": fmt.Sprintf("%d", percent),
+	})
+}
+
+// SetColor sets a color bulb's hue (0-359) and saturation (0-255),
+// ramping over duration. It is equivalent to SetColorContext with
+// context.Background().
+func (s *DeviceService) SetColor(d *Device, hue, saturation uint16, duration time.Duration) error {
+	return s.SetColorContext(context.Background(), d, hue, saturation, duration)
+}
+
+// SetColorContext sets a color bulb's hue (0-359) and saturation
+// (0-255), ramping over duration, bound to ctx.
+func (s *DeviceService) SetColorContext(ctx context.Context, d *Device, hue, saturation uint16, duration time.Duration) error {
+	if err := lightingPrecheck(d, d.IsColorBulb()); err != nil {
+		return err
+	}
+	return s.sendCommand(ctx, "setcolor", map[string]string{
+		"ain":        cleanAin(d.Identifier),
+		"hue":        fmt.Sprintf("%d", hue),
+		"saturation": fmt.Sprintf("%d", saturation),
+		"duration":   fmt.Sprintf("%d", duration/(100*time.Millisecond)),
+	})
+}
+
+// SetColorTemperature sets a color bulb's white color temperature, in
+// Kelvin, ramping over duration. It is equivalent to
+// SetColorTemperatureContext with context.Background().
+func (s *DeviceService) SetColorTemperature(d *Device, kelvin uint16, duration time.Duration) error {
+	return s.SetColorTemperatureContext(context.Background(), d, kelvin, duration)
+}
+
+// SetColorTemperatureContext sets a color bulb's white color
+// temperature, in Kelvin, ramping over duration, bound to ctx.
+func (s *DeviceService) SetColorTemperatureContext(ctx context.Context, d *Device, kelvin uint16, duration time.Duration) error {
+	if err := lightingPrecheck(d, d.IsColorBulb()); err != nil {
+		return err
+	}
+	return s.sendCommand(ctx, "setcolortemperature", map[string]string{
+		"ain":         cleanAin(d.Identifier),
+		"temperature": fmt.Sprintf("%d", kelvin),
+		"duration":    fmt.Sprintf("%d", duration/(100*time.Millisecond)),
+	})
+}
+
+// SetBlind drives a blind/shutter towards target. It is equivalent to
+// SetBlindContext with context.Background().
+func (s *DeviceService) SetBlind(d *Device, target BlindTarget) error {
+	return s.SetBlindContext(context.Background(), d, target)
+}
+
+// SetBlindContext drives a blind/shutter towards target, bound to ctx.
+func (s *DeviceService) SetBlindContext(ctx context.Context, d *Device, target BlindTarget) error {
+	if err := lightingPrecheck(d, d.IsBlind()); err != nil {
+		return err
+	}
+	return s.sendCommand(ctx, "setblind", map[string]string{
+		"ain":    cleanAin(d.Identifier),
+		"target": string(target),
+	})
+}
+
+// sendCommand issues cmd against the AHA-HTTP interface, discarding the
+// response body.
+func (s *DeviceService) sendCommand(ctx context.Context, cmd string, params map[string]string) error {
+	u, err := commandURL(cmd, params)
+	if err != nil {
+		return err
+	}
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.DoWithContext(ctx, req, nil)
+	return err
+}
@@ -7,15 +7,22 @@ package fritzbox
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 	"unicode/utf16"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -36,6 +43,20 @@ var (
 	ErrExpiredSess = errors.New("fritzbox: session expired")
 )
 
+// AuthScheme identifies which challenge-response scheme a Session used
+// to authenticate.
+type AuthScheme int
+
+const (
+	// AuthSchemeMD5 is AVM's legacy UTF-16LE+MD5 challenge-response
+	// scheme, used by challenges that don't start with "2$".
+	AuthSchemeMD5 AuthScheme = iota
+	// AuthSchemePBKDF2 is the two-stage PBKDF2-HMAC-SHA256 scheme
+	// introduced by newer FRITZ!OS versions, used by challenges of the
+	// form "2$<iter1>$<salt1>$<iter2>$<salt2>".
+	AuthSchemePBKDF2
+)
+
 // Session represents a FRITZ!Box session
 type Session struct {
 	client *Client
@@ -52,6 +73,10 @@ type Session struct {
 
 	// Session expires after 10 minutes
 	Expires time.Time `xml:"-"`
+
+	// AuthScheme is set by Auth/AuthContext to whichever scheme was
+	// used to answer Challenge.
+	AuthScheme AuthScheme `xml:"-"`
 }
 
 // NewSession returns a new FRITZ!Box session.
@@ -62,14 +87,20 @@ func NewSession(c *Client) *Session {
 	}
 }
 
-// Open retrieves the challenge from FRITZ!Box.
+// Open retrieves the challenge from FRITZ!Box. It is equivalent to
+// OpenContext with context.Background().
 func (s *Session) Open() error {
-	req, err := s.client.NewRequest("GET", "login_sid.lua", nil)
+	return s.OpenContext(context.Background())
+}
+
+// OpenContext retrieves the challenge from FRITZ!Box, bound to ctx.
+func (s *Session) OpenContext(ctx context.Context) error {
+	req, err := s.client.NewRequestWithContext(ctx, "GET", "login_sid.lua", nil)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.client.Do(req, s)
+	_, err = s.client.DoWithContext(ctx, req, s)
 	if err != nil {
 		return err
 	}
@@ -77,15 +108,23 @@ func (s *Session) Open() error {
 	return nil
 }
 
-// Auth sends the Response (Challenge-Response) to the FRITZ!Box and
-// returns an error, if any.
+// Auth sends the Response (Challenge-Response) to the FRITZ!Box. It is
+// equivalent to AuthContext with context.Background().
 func (s *Session) Auth(username, password string) error {
-	cr, err := computeResponse(s.Challenge, password)
+	return s.AuthContext(context.Background(), username, password)
+}
+
+// AuthContext sends the Response (Challenge-Response) to the FRITZ!Box,
+// bound to ctx, and returns an error, if any. The scheme used is
+// detected from Challenge and recorded in AuthScheme.
+func (s *Session) AuthContext(ctx context.Context, username, password string) error {
+	cr, scheme, err := computeChallengeResponse(s.Challenge, password)
 	if err != nil {
 		return err
 	}
+	s.AuthScheme = scheme
 
-	req, err := s.client.NewRequest("POST", "login_sid.lua", url.Values{
+	req, err := s.client.NewRequestWithContext(ctx, "POST", "login_sid.lua", url.Values{
 		"username": {username},
 		"response": {cr},
 	})
@@ -93,7 +132,7 @@ func (s *Session) Auth(username, password string) error {
 		return err
 	}
 
-	_, err = s.client.Do(req, s)
+	_, err = s.client.DoWithContext(ctx, req, s)
 	if err != nil {
 		return err
 	}
@@ -103,7 +142,7 @@ func (s *Session) Auth(username, password string) error {
 		return ErrInvalidCred
 	}
 
-	s.Refresh()
+	s.RefreshContext(ctx)
 	return nil
 }
 
@@ -112,13 +151,29 @@ func (s *Session) Close() {
 	s.Sid = DefaultSid
 }
 
+// String returns the session's SID.
+func (s *Session) String() string {
+	return s.Sid
+}
+
 // IsExpired returns true if session is expired
 func (s *Session) IsExpired() bool {
 	return s.Expires.Before(time.Now())
 }
 
-// Refresh updates expires
+// Refresh updates expires. It is equivalent to RefreshContext with
+// context.Background().
 func (s *Session) Refresh() error {
+	return s.RefreshContext(context.Background())
+}
+
+// RefreshContext updates expires, honoring ctx cancellation. If the
+// session has already expired on the FRITZ!Box, it is closed and
+// ErrExpiredSess is returned.
+func (s *Session) RefreshContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if s.IsExpired() && (s.Expires != time.Time{}) {
 		s.Close()
 		return ErrExpiredSess
@@ -127,6 +182,54 @@ func (s *Session) Refresh() error {
 	return nil
 }
 
+// computeChallengeResponse dispatches to the PBKDF2 or legacy MD5
+// challenge-response scheme depending on the form of challenge, and
+// reports which one it used.
+func computeChallengeResponse(challenge, secret string) (string, AuthScheme, error) {
+	if strings.HasPrefix(challenge, "2$") {
+		r, err := computePBKDF2Response(challenge, secret)
+		return r, AuthSchemePBKDF2, err
+	}
+
+	r, err := computeResponse(challenge, secret)
+	return r, AuthSchemeMD5, err
+}
+
+// computePBKDF2Response answers a PBKDF2 challenge of the form
+// "2$<iter1>$<salt1>$<iter2>$<salt2>" (salts hex encoded). The key is
+// derived in two stages: PBKDF2-HMAC-SHA256(password, salt1, iter1)
+// produces an intermediate key, which is then run back through
+// PBKDF2-HMAC-SHA256(intermediate, salt2, iter2) to produce the final
+// key. The response is "<salt2>$<hex(finalKey)>".
+func computePBKDF2Response(challenge, secret string) (string, error) {
+	parts := strings.Split(challenge, "$")
+	if len(parts) != 5 || parts[0] != "2" {
+		return "", fmt.Errorf("fritzbox: invalid PBKDF2 challenge %q", challenge)
+	}
+
+	iter1, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("fritzbox: invalid PBKDF2 challenge %q: %v", challenge, err)
+	}
+	salt1, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("fritzbox: invalid PBKDF2 challenge %q: %v", challenge, err)
+	}
+	iter2, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return "", fmt.Errorf("fritzbox: invalid PBKDF2 challenge %q: %v", challenge, err)
+	}
+	salt2, err := hex.DecodeString(parts[4])
+	if err != nil {
+		return "", fmt.Errorf("fritzbox: invalid PBKDF2 challenge %q: %v", challenge, err)
+	}
+
+	intermediate := pbkdf2.Key([]byte(secret), salt1, iter1, sha256.Size, sha256.New)
+	final := pbkdf2.Key(intermediate, salt2, iter2, sha256.Size, sha256.New)
+
+	return fmt.Sprintf("%s$%s", parts[4], hex.EncodeToString(final)), nil
+}
+
 // ComputeResponse generates a response for challenge-response auth
 // with the given challenge and secret. It returns the reponse and
 // and an error, if any.
@@ -195,3 +195,59 @@ func TestComputeResponse(t *testing.T) {
 		}
 	}
 }
+
+// computeChallengeResponse test cases, covering both the legacy MD5 and
+// the PBKDF2 challenge-response schemes.
+var testsChallengeResponse = []struct {
+	Name      string
+	Challenge string
+	Password  string
+	Want      string
+	Scheme    AuthScheme
+}{
+	{
+		Name:      "MD5",
+		Challenge: "1234567z",
+		Password:  "äbc",
+		Want:      "1234567z-9e224a41eeefa284df7bb0f26c2913e2",
+		Scheme:    AuthSchemeMD5,
+	},
+	{
+		Name:      "PBKDF2",
+		Challenge: "2$10000$5A1711B5$2000$5A1711C1",
+		Password:  "secret",
+		Want:      "5A1711C1$5fc9b3b9382f825aeb36a5e09344f548a1b96fb6cbbe83c7b43317eef64e18b9",
+		Scheme:    AuthSchemePBKDF2,
+	},
+	{
+		Name:      "PBKDF2 mixed-case password",
+		Challenge: "2$10000$5A1711B5$2000$5A1711C1",
+		Password:  "sEcR3t!",
+		Want:      "5A1711C1$6ffaea3e13835a8c146ba4e8454a8ff0223f7cfe07058bfec41ad614eb05bd86",
+		Scheme:    AuthSchemePBKDF2,
+	},
+}
+
+func TestComputeChallengeResponse(t *testing.T) {
+	for _, c := range testsChallengeResponse {
+		t.Run(c.Name, func(t *testing.T) {
+			r, scheme, err := computeChallengeResponse(c.Challenge, c.Password)
+			if err != nil {
+				t.Fatalf("computeChallengeResponse unexpected error %v", err)
+			}
+			if r != c.Want {
+				t.Errorf("computeChallengeResponse response is %s, want %s", r, c.Want)
+			}
+			if scheme != c.Scheme {
+				t.Errorf("computeChallengeResponse scheme is %v, want %v", scheme, c.Scheme)
+			}
+		})
+	}
+}
+
+func TestComputePBKDF2Response_invalidChallenge(t *testing.T) {
+	_, err := computePBKDF2Response("2$not-a-valid-challenge", "secret")
+	if err == nil {
+		t.Error("Expected error to be returned")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+// TemplateService handles fritz!Box templates, reusable bundles of
+// device settings configured via "Smart Home" > "Vorlagen" in the
+// FRITZ!Box UI.
+type TemplateService struct {
+	c *Client
+}
+
+// templateList represents a list of templates returned by the
+// fritz!Box.
+type templateList struct {
+	XMLName   xml.Name    `xml:"templatelist"`
+	Version   string      `xml:"version,attr"`
+	Templates []*Template `xml:"template"`
+}
+
+// Template represents a template returned by the fritz!Box.
+type Template struct {
+	XMLName    xml.Name `xml:"template"`
+	Identifier string   `xml:"identifier,attr"`
+	Name       string   `xml:"name"`
+}
+
+// List returns a list of all templates. It is equivalent to ListContext
+// with context.Background().
+func (s *TemplateService) List() ([]*Template, error) {
+	return s.ListContext(context.Background())
+}
+
+// ListContext returns a list of all templates, bound to ctx.
+func (s *TemplateService) ListContext(ctx context.Context) ([]*Template, error) {
+	u, err := commandURL("gettemplatelistinfos", nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var list templateList
+	if _, err := s.c.DoWithContext(ctx, req, &list); err != nil {
+		return nil, err
+	}
+	return list.Templates, nil
+}
+
+// ApplyTemplate applies the template identified by ain, immediately
+// putting its member devices into the settings it captures. It is
+// equivalent to ApplyTemplateContext with context.Background().
+func (s *TemplateService) ApplyTemplate(ain string) error {
+	return s.ApplyTemplateContext(context.Background(), ain)
+}
+
+// ApplyTemplateContext applies the template identified by ain, bound to
+// ctx.
+func (s *TemplateService) ApplyTemplateContext(ctx context.Context, ain string) error {
+	u, err := commandURL("applytemplate", map[string]string{
+		"ain": cleanAin(ain),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := s.c.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.DoWithContext(ctx, req, nil)
+	return err
+}
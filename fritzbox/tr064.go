@@ -0,0 +1,426 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// TR064Service talks to the FRITZ!Box's TR-064 SOAP interface over plain
+// HTTP (port 49000 by default), as a sibling to the AHA-HTTP based
+// DeviceService. The TLS port 49443 is not used. Unlike
+// DeviceService, TR-064 is authenticated with HTTP Digest rather than an
+// AHA-HTTP SID, so credentials are kept separately on Username/Password.
+type TR064Service struct {
+	c *Client
+
+	// Addr is the host:port of the TR-064 control endpoint, e.g.
+	// "fritz.box:49000". If empty, it is derived from Client.BaseURL's
+	// host with the default TR-064 port appended.
+	Addr string
+
+	// Username and Password authenticate requests via HTTP Digest.
+	Username string
+	Password string
+
+	mu   sync.Mutex
+	desc *tr064Root // cached /tr64desc.xml
+}
+
+// tr064Root is the top-level element of /tr64desc.xml.
+type tr064Root struct {
+	XMLName xml.Name    `xml:"root"`
+	Device  tr064Device `xml:"device"`
+}
+
+// tr064Device describes a device (and its nested sub-devices) found in
+// /tr64desc.xml, along with the services it exposes.
+type tr064Device struct {
+	DeviceType   string             `xml:"deviceType"`
+	FriendlyName string             `xml:"friendlyName"`
+	ServiceList  []tr064ServiceDesc `xml:"serviceList>service"`
+	DeviceList   []tr064Device      `xml:"deviceList>device"`
+}
+
+// tr064ServiceDesc describes a single TR-064 service's SCPD and control
+// endpoints.
+type tr064ServiceDesc struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+	SCPDURL     string `xml:"SCPDURL"`
+}
+
+// addr returns the host:port to reach the TR-064 control endpoint on.
+func (s *TR064Service) addr() string {
+	if s.Addr != "" {
+		return s.Addr
+	}
+	host := "fritz.box"
+	if s.c.BaseURL != nil && s.c.BaseURL.Hostname() != "" {
+		host = s.c.BaseURL.Hostname()
+	}
+	return host + ":49000"
+}
+
+// description fetches and caches /tr64desc.xml.
+func (s *TR064Service) description(ctx context.Context) (*tr064Root, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.desc != nil {
+		return s.desc, nil
+	}
+
+	u := fmt.Sprintf("http://%s/tr64desc.xml", s.addr())
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fritzbox: tr064: fetching %s: %s", u, resp.Status)
+	}
+
+	var root tr064Root
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	s.desc = &root
+	return &root, nil
+}
+
+// lookupService finds the service whose serviceType contains name (e.g.
+// "WANIPConnection" matches "urn:dslforum-org:service:WANIPConnection:1").
+func (s *TR064Service) lookupService(ctx context.Context, name string) (*tr064ServiceDesc, error) {
+	root, err := s.description(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sd := findService(&root.Device, name); sd != nil {
+		return sd, nil
+	}
+	return nil, fmt.Errorf("fritzbox: tr064: service %q not found in tr64desc.xml", name)
+}
+
+func findService(d *tr064Device, name string) *tr064ServiceDesc {
+	for i := range d.ServiceList {
+		if strings.Contains(d.ServiceList[i].ServiceType, name) {
+			return &d.ServiceList[i]
+		}
+	}
+	for i := range d.DeviceList {
+		if sd := findService(&d.DeviceList[i], name); sd != nil {
+			return sd
+		}
+	}
+	return nil
+}
+
+// soapResponseEnvelope unwraps a SOAP response down to its Body, leaving
+// the action response element as raw XML to be decoded into the
+// caller's out value.
+type soapResponseEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Inner []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// Invoke calls action on service. It is equivalent to InvokeContext with
+// context.Background().
+func (s *TR064Service) Invoke(service, action string, in, out interface{}) error {
+	return s.InvokeContext(context.Background(), service, action, in, out)
+}
+
+// InvokeContext calls action on service, bound to ctx. in, if non-nil, is
+// marshaled as the action's arguments (its exported fields become SOAP
+// argument elements, so it should use the same xml struct tags as the
+// fields in the TR-064 service's SCPD); out, if non-nil, receives the
+// decoded response arguments the same way.
+func (s *TR064Service) InvokeContext(ctx context.Context, service, action string, in, out interface{}) error {
+	sd, err := s.lookupService(ctx, service)
+	if err != nil {
+		return err
+	}
+
+	body, err := buildSOAPEnvelope(sd.ServiceType, action, in)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("http://%s%s", s.addr(), sd.ControlURL)
+	soapAction := fmt.Sprintf(`"%s#%s"`, sd.ServiceType, action)
+
+	resp, err := s.doDigest(ctx, "POST", endpoint, body, map[string]string{
+		"Content-Type": `text/xml; charset="utf-8"`,
+		"SOAPAction":   soapAction,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("fritzbox: tr064: %s#%s: %s: %s", service, action, resp.Status, string(respBody))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	var env soapResponseEnvelope
+	if err := xml.Unmarshal(respBody, &env); err != nil {
+		return err
+	}
+	return xml.Unmarshal(env.Body.Inner, out)
+}
+
+// buildSOAPEnvelope wraps in's argument elements in a SOAP envelope
+// addressing serviceType#action.
+func buildSOAPEnvelope(serviceType, action string, in interface{}) ([]byte, error) {
+	args, err := marshalActionArgs(in)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := xml.Header + fmt.Sprintf(
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u=%q>%s</u:%s></s:Body></s:Envelope>`,
+		action, serviceType, args, action,
+	)
+	return []byte(envelope), nil
+}
+
+// marshalActionArgs renders in's fields as SOAP argument elements,
+// stripping the outer element that xml.Marshal wraps them in.
+func marshalActionArgs(in interface{}) (string, error) {
+	if in == nil {
+		return "", nil
+	}
+	raw, err := xml.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+	start := bytes.IndexByte(raw, '>')
+	end := bytes.LastIndexByte(raw, '<')
+	if start < 0 || end <= start {
+		return "", nil
+	}
+	return string(raw[start+1 : end]), nil
+}
+
+// doDigest sends an HTTP request, transparently handling the HTTP Digest
+// challenge-response TR-064 requires.
+func (s *TR064Service) doDigest(ctx context.Context, method, rawURL string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := newRequestWithBody(ctx, method, rawURL, body, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	challenge := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if challenge == nil {
+		return resp, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	authReq, err := newRequestWithBody(ctx, method, rawURL, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	authReq.Header.Set("Authorization", s.digestAuthorization(method, u.RequestURI(), challenge))
+
+	return s.c.client.Do(authReq)
+}
+
+func newRequestWithBody(ctx context.Context, method, rawURL string, body []byte, headers map[string]string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// digestAuthorization computes an RFC 2617 Digest Authorization header
+// value (qop=auth, MD5) for a request to uri.
+func (s *TR064Service) digestAuthorization(method, uri string, challenge map[string]string) string {
+	realm := challenge["realm"]
+	nonce := challenge["nonce"]
+	qop := firstQop(challenge["qop"])
+	opaque := challenge["opaque"]
+
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", s.Username, realm, s.Password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+
+	nc := "00000001"
+	cnonce := randomHex(8)
+
+	var response string
+	if qop != "" {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, nc, cnonce, qop, ha2))
+	} else {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+	}
+
+	parts := []string{
+		fmt.Sprintf(`username="%s"`, s.Username),
+		fmt.Sprintf(`realm="%s"`, realm),
+		fmt.Sprintf(`nonce="%s"`, nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if qop != "" {
+		parts = append(parts, fmt.Sprintf(`qop=%s`, qop), fmt.Sprintf(`nc=%s`, nc), fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if opaque != "" {
+		parts = append(parts, fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+
+	return "Digest " + strings.Join(parts, ", ")
+}
+
+// firstQop returns the first of a comma-separated qop-options list.
+func firstQop(qop string) string {
+	if i := strings.IndexByte(qop, ','); i >= 0 {
+		return strings.TrimSpace(qop[:i])
+	}
+	return qop
+}
+
+// parseDigestChallenge parses a WWW-Authenticate: Digest ... header into
+// its key/value parameters. It returns nil if header isn't a Digest
+// challenge.
+func parseDigestChallenge(header string) map[string]string {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil
+	}
+	header = strings.TrimPrefix(header, "Digest ")
+
+	params := make(map[string]string)
+	for _, field := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// crypto/rand.Read never returns a partial read without an error on
+	// supported platforms.
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// WANIPConnectionService wraps the urn:dslforum-org:service:WANIPConnection
+// TR-064 service.
+type WANIPConnectionService struct {
+	tr *TR064Service
+}
+
+// WANIPConnection returns a wrapper for the WANIPConnection TR-064
+// service.
+func (s *TR064Service) WANIPConnection() *WANIPConnectionService {
+	return &WANIPConnectionService{tr: s}
+}
+
+// ForceTermination tears down and re-establishes the WAN connection.
+func (w *WANIPConnectionService) ForceTermination() error {
+	return w.tr.Invoke("WANIPConnection", "ForceTermination", nil, nil)
+}
+
+// HostsService wraps the urn:dslforum-org:service:Hosts TR-064 service.
+type HostsService struct {
+	tr *TR064Service
+}
+
+// Hosts returns a wrapper for the Hosts TR-064 service.
+func (s *TR064Service) Hosts() *HostsService {
+	return &HostsService{tr: s}
+}
+
+// GetHostNumberOfEntries returns the number of entries in the host table.
+func (h *HostsService) GetHostNumberOfEntries() (int, error) {
+	var out struct {
+		NewHostNumberOfEntries int `xml:"NewHostNumberOfEntries"`
+	}
+	if err := h.tr.Invoke("Hosts", "GetHostNumberOfEntries", nil, &out); err != nil {
+		return 0, err
+	}
+	return out.NewHostNumberOfEntries, nil
+}
+
+// OnTelService wraps the urn:dslforum-org:service:X_AVM-DE_OnTel
+// TR-064 service.
+type OnTelService struct {
+	tr *TR064Service
+}
+
+// OnTel returns a wrapper for the X_AVM-DE_OnTel TR-064 service.
+func (s *TR064Service) OnTel() *OnTelService {
+	return &OnTelService{tr: s}
+}
+
+// GetCallList returns the URL the FRITZ!Box serves the call list XML
+// document from.
+func (o *OnTelService) GetCallList() (string, error) {
+	var out struct {
+		NewCallListURL string `xml:"NewCallListURL"`
+	}
+	if err := o.tr.Invoke("X_AVM-DE_OnTel", "GetCallList", nil, &out); err != nil {
+		return "", err
+	}
+	return out.NewCallListURL, nil
+}
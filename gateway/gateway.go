@@ -0,0 +1,241 @@
+// Copyright 2015 The go-fritzbox AUTHORS. All rights reserved.
+//
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gateway wraps a fritzbox.Client in an http.Handler, exposing a
+// small JSON REST surface plus an SSE event stream, so tools that can't
+// embed Go (Home Assistant, a Prometheus scraper, a shell script) can
+// drive a FRITZ!Box without speaking AHA-HTTP directly.
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/philippfranke/go-fritzbox/fritzbox"
+)
+
+// Handler serves:
+//
+//	GET  /devices              list devices
+//	GET  /devices/{ain}        get a device
+//	POST /devices/{ain}/on     turn a device on
+//	POST /devices/{ain}/off    turn a device off
+//	POST /devices/{ain}/toggle toggle a device
+//	GET  /devices/{ain}/soll   get a thermostat's soll temperature
+//	PUT  /devices/{ain}/soll   set a thermostat's soll temperature
+//	GET  /devices/{ain}/power  get a socket's current power draw
+//	GET  /events               SSE stream of fritzbox.TelemetryEvents
+//
+// Requests may carry HTTP basic auth; credentials are forwarded into
+// Client.Auth before the request is served. Mutating requests (POST,
+// PUT, PATCH, DELETE) must carry the CSRF token returned in the X-CSRF-Token
+// response header of a prior request, either as an X-CSRF-Token request
+// header or a csrf_token query parameter, mirroring syncthing's GUI API.
+type Handler struct {
+	// Client is the Client the Handler serves.
+	Client *fritzbox.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewHandler returns a Handler serving c.
+func NewHandler(c *fritzbox.Client) *Handler {
+	return &Handler{Client: c}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); ok {
+		if err := h.Client.AuthContext(r.Context(), username, password); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if isMutating(r) && !h.checkCSRFToken(r) {
+		http.Error(w, "gateway: missing or invalid X-CSRF-Token", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("X-CSRF-Token", h.csrfToken())
+
+	switch {
+	case r.URL.Path == "/devices" && r.Method == http.MethodGet:
+		h.listDevices(w, r)
+	case r.URL.Path == "/events" && r.Method == http.MethodGet:
+		h.streamEvents(w, r)
+	case strings.HasPrefix(r.URL.Path, "/devices/"):
+		h.serveDevice(w, r, strings.TrimPrefix(r.URL.Path, "/devices/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// csrfToken lazily generates the token required on mutating requests on
+// first use, and hands it back to every caller, mutating or not, so a
+// client can obtain one with a preceding GET.
+func (h *Handler) csrfToken() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.token == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			panic("gateway: crypto/rand failed: " + err.Error())
+		}
+		h.token = hex.EncodeToString(buf)
+	}
+	return h.token
+}
+
+func (h *Handler) checkCSRFToken(r *http.Request) bool {
+	got := r.Header.Get("X-CSRF-Token")
+	if got == "" {
+		got = r.URL.Query().Get("csrf_token")
+	}
+	want := h.csrfToken()
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func (h *Handler) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := h.Client.DeviceService.ListContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, devices)
+}
+
+// serveDevice dispatches a request under /devices/, where rest is the
+// path following that prefix: "{ain}" or "{ain}/{action}".
+func (h *Handler) serveDevice(w http.ResponseWriter, r *http.Request, rest string) {
+	parts := strings.SplitN(strings.Trim(rest, "/"), "/", 2)
+	ain := parts[0]
+	if ain == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var action string
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	d, err := h.Client.DeviceService.GetContext(r.Context(), ain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, d)
+	case action == "on" && r.Method == http.MethodPost:
+		_, err := h.Client.DeviceService.TurnOnContext(r.Context(), d)
+		h.writeResult(w, err)
+	case action == "off" && r.Method == http.MethodPost:
+		_, err := h.Client.DeviceService.TurnOffContext(r.Context(), d)
+		h.writeResult(w, err)
+	case action == "toggle" && r.Method == http.MethodPost:
+		_, err := h.Client.DeviceService.ToggleContext(r.Context(), d)
+		h.writeResult(w, err)
+	case action == "soll" && r.Method == http.MethodGet:
+		temp, err := h.Client.DeviceService.GetSollTemperatureContext(r.Context(), d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct {
+			Soll float64 `json:"soll"`
+		}{temp})
+	case action == "soll" && r.Method == http.MethodPut:
+		var body struct {
+			Soll float64 `json:"soll"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := h.Client.DeviceService.SetSollTemperatureContext(r.Context(), d, body.Soll)
+		h.writeResult(w, err)
+	case action == "power" && r.Method == http.MethodGet:
+		power, err := h.Client.DeviceService.GetPowerContext(r.Context(), d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct {
+			PowerMW int64 `json:"powerMW"`
+		}{power})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamEvents serves /events as a text/event-stream, relaying every
+// fritzbox.TelemetryEvent from the Client's EventService until the
+// request's context is cancelled. Client.EventService.Run must already
+// be running in another goroutine for any events to arrive.
+func (h *Handler) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "gateway: streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.Client.EventService.Subscribe(fritzbox.EventMaskAll)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeResult acks a command that has no response body of its own: a 500
+// with err's message if it failed, or a bare 204 if it succeeded.
+func (h *Handler) writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}